@@ -0,0 +1,74 @@
+package retry
+
+import (
+	"context"
+	"sync"
+)
+
+// Barrier synchronizes attempts across goroutines: Wait blocks until every
+// participant has arrived or ctx is done. A participant calls Leave once it
+// is done, so the others stop waiting for it.
+type Barrier interface {
+	Wait(ctx context.Context) error
+	Leave()
+}
+
+type cyclicBarrier struct {
+	mu      sync.Mutex
+	parties uint
+	arrived uint
+	release chan struct{}
+}
+
+// NewBarrier returns a Barrier that releases its waiters each time all the
+// parties that haven't left have arrived.
+func NewBarrier(parties uint) Barrier {
+	return &cyclicBarrier{
+		parties: parties,
+		release: make(chan struct{}),
+	}
+}
+
+func (b *cyclicBarrier) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	b.arrived++
+	if b.arrived >= b.parties {
+		b.releaseLocked()
+		b.mu.Unlock()
+		return nil
+	}
+	release := b.release
+	b.mu.Unlock()
+
+	select {
+	case <-release:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		select {
+		case <-release:
+			return nil
+		default:
+		}
+		b.arrived--
+		return ctx.Err()
+	}
+}
+
+func (b *cyclicBarrier) Leave() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.parties > 0 {
+		b.parties--
+	}
+	if b.arrived > 0 && b.arrived >= b.parties {
+		b.releaseLocked()
+	}
+}
+
+func (b *cyclicBarrier) releaseLocked() {
+	close(b.release)
+	b.release = make(chan struct{})
+	b.arrived = 0
+}
@@ -0,0 +1,88 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoWithBarrier(t *testing.T) {
+	parties := uint(3)
+	attempts := uint(4)
+	barrier := NewBarrier(parties)
+
+	var mu sync.Mutex
+	var rounds []uint
+	var wg sync.WaitGroup
+	for i := uint(0); i < parties; i++ {
+		wg.Add(1)
+		go func(i uint) {
+			defer wg.Done()
+			var n uint
+			_ = Do(func() error {
+				mu.Lock()
+				rounds = append(rounds, n)
+				mu.Unlock()
+				n++
+				// stagger the goroutines so an unsynchronized run would interleave
+				time.Sleep(time.Duration(i) * 5 * time.Millisecond)
+				return errors.New("error")
+			}, WithBarrier(barrier), WithAttempts(attempts))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Len(t, rounds, int(parties*attempts))
+	for i := 1; i < len(rounds); i++ {
+		assert.True(t, rounds[i-1] <= rounds[i], "goroutines should advance rounds together")
+	}
+}
+
+func TestBarrierContextCanceled(t *testing.T) {
+	barrier := NewBarrier(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := Do(func() error {
+		return nil
+	}, WithBarrier(barrier), WithContext(ctx))
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestBarrierParticipantSucceedsEarly(t *testing.T) {
+	parties := uint(3)
+	barrier := NewBarrier(parties)
+
+	var wg sync.WaitGroup
+	var calls [3]int
+	for i := 0; i < int(parties); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = Do(func() error {
+				calls[i]++
+				if i == 0 {
+					return nil
+				}
+				return errors.New("error")
+			}, WithBarrier(barrier), WithAttempts(3), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the participants left should not wait for the one that succeeded")
+	}
+	assert.Equal(t, [3]int{1, 3, 3}, calls)
+}
@@ -0,0 +1,122 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrBatchAborted is wrapped into the error of every DoAll item whose
+// retries were cut short by WithBatchAbortIfFailureRate.
+var ErrBatchAborted = errors.New("retry: batch aborted")
+
+// DoAll retries every function in fs concurrently, each with its own Do loop
+// configured by opts, and returns their errors in the same order as fs.
+func DoAll(fs []func() error, opts ...Option) []error {
+	batchCfg := newConfig(opts...)
+	batch := &batchState{
+		abortFraction:   batchCfg.batchAbortFraction,
+		abortMinSamples: batchCfg.batchAbortMinSamples,
+	}
+	errs := make([]error, len(fs))
+
+	var wg sync.WaitGroup
+	for i, f := range fs {
+		cfg := newConfig(opts...)
+		cfg.batch = batch
+
+		wg.Add(1)
+		go func(i int, f func() error, cfg *config) {
+			defer wg.Done()
+			err := do(func(context.Context) error { return f() }, cfg)
+			if err != nil && cfg.batchCut {
+				err = fmt.Errorf("%w: %w", ErrBatchAborted, err)
+			}
+			batch.complete(err == nil)
+			errs[i] = err
+		}(i, f, cfg)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// ChronologicalErrors merges the errors of concurrent Do calls, e.g. the
+// items of DoAll, into one Error holding every failed attempt in the order it
+// occurred, by the time recorded with WithChronologicalErrors or
+// WithEnrichErrors. Every entry is an AttemptError numbered within its own
+// call. Entries without a time come last, and nil errors are skipped.
+func ChronologicalErrors(errs ...error) Error {
+	var merged Error
+	var times []time.Time
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		entries := Error{err}
+		if e, ok := asError[Error](err); ok {
+			entries = e
+		}
+		for i, entry := range entries {
+			ae, ok := entry.(AttemptError)
+			if !ok {
+				ae = AttemptError{Err: entry, Attempt: uint(i)}
+			}
+			var when time.Time
+			if enriched, ok := asError[EnrichedError](entry); ok {
+				when = enriched.When
+			}
+			merged = append(merged, ae)
+			times = append(times, when)
+		}
+	}
+
+	order := make([]int, len(merged))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		ti, tj := times[order[i]], times[order[j]]
+		if ti.IsZero() || tj.IsZero() {
+			return !ti.IsZero() && tj.IsZero()
+		}
+		return ti.Before(tj)
+	})
+	sorted := make(Error, len(merged))
+	for i, j := range order {
+		sorted[i] = merged[j]
+	}
+	return sorted
+}
+
+// batchState tracks the outcome of the items of a DoAll call.
+type batchState struct {
+	mu              sync.Mutex
+	abortFraction   float64
+	abortMinSamples uint
+	completed       uint
+	failed          uint
+	aborted         bool
+}
+
+func (b *batchState) complete(succeeded bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.completed++
+	if !succeeded {
+		b.failed++
+	}
+	if b.abortFraction > 0 && b.completed >= b.abortMinSamples &&
+		float64(b.failed)/float64(b.completed) > b.abortFraction {
+		b.aborted = true
+	}
+}
+
+func (b *batchState) isAborted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.aborted
+}
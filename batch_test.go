@@ -0,0 +1,95 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoAll(t *testing.T) {
+	expectErr := errors.New("error")
+	var calls int32
+	errs := DoAll([]func() error{
+		func() error { return nil },
+		func() error {
+			if atomic.AddInt32(&calls, 1) < 3 {
+				return expectErr
+			}
+			return nil
+		},
+		func() error { return UnrecoverableError(expectErr) },
+	})
+
+	assert.Len(t, errs, 3)
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+	assert.True(t, errors.Is(errs[2], expectErr))
+}
+
+func TestDoAllBatchAbortIfFailureRate(t *testing.T) {
+	var fs []func() error
+	for i := 0; i < 8; i++ {
+		fs = append(fs, func() error {
+			return UnrecoverableError(errors.New("outage"))
+		})
+	}
+	var slowCalls int32
+	for i := 0; i < 2; i++ {
+		fs = append(fs, func() error {
+			atomic.AddInt32(&slowCalls, 1)
+			return errors.New("error")
+		})
+	}
+
+	errs := DoAll(fs, WithBatchAbortIfFailureRate(0.5, 4), WithDelayFn(FixDelayFn, SetFixTimeFn(50*time.Millisecond)))
+
+	for i, err := range errs {
+		assert.Error(t, err, fmt.Sprintf("item %v should fail", i))
+	}
+	assert.True(t, atomic.LoadInt32(&slowCalls) < 2*int32(defaultAttempts), "retrying items should stop early")
+	assert.True(t, errors.Is(errs[8], ErrBatchAborted))
+	assert.True(t, errors.Is(errs[9], ErrBatchAborted))
+	assert.False(t, errors.Is(errs[0], ErrBatchAborted), "items that failed on their own shouldn't be marked aborted")
+}
+
+func TestChronologicalErrors(t *testing.T) {
+	start := time.Now()
+	at := func(ms int, msg string) error {
+		return EnrichedError{Err: errors.New(msg), When: start.Add(time.Duration(ms) * time.Millisecond)}
+	}
+
+	merged := ChronologicalErrors(
+		Error{at(0, "a0"), at(20, "a1")},
+		nil,
+		fmt.Errorf("%w: %w", ErrBatchAborted, Error{at(10, "b0"), errors.New("b1"), at(30, "b2")}),
+	)
+	assert.Equal(t, "Retry Error: \n# 0: a0\n# 0: b0\n# 1: a1\n# 2: b2\n# 1: b1", merged.Error(),
+		"entries should be ordered by time across calls, untimed ones last")
+}
+
+func TestDoAllChronologicalErrors(t *testing.T) {
+	const items = 5
+	var fs []func() error
+	for i := 0; i < items; i++ {
+		i := i
+		fs = append(fs, func() error {
+			return fmt.Errorf("item %d", i)
+		})
+	}
+
+	errs := DoAll(fs, WithAttempts(3), WithDelay(time.Millisecond), WithChronologicalErrors(true))
+	merged := ChronologicalErrors(errs...)
+
+	assert.Len(t, merged, 3*items)
+	var last time.Time
+	for _, err := range merged {
+		var enriched EnrichedError
+		assert.True(t, errors.As(err, &enriched))
+		assert.False(t, enriched.When.Before(last), "errors should be in chronological order")
+		last = enriched.When
+	}
+}
@@ -0,0 +1,81 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNestedBudgetExhausted is returned by a Do call that could not make a
+// single attempt because an enclosing Do with WithNestedBudget has no attempts
+// left.
+var ErrNestedBudgetExhausted = errors.New("retry: nested budget exhausted")
+
+type nestedBudgetKey struct{}
+
+// nestedBudget is shared through the context between a Do with
+// WithNestedBudget and the Do calls nested in its f. Every attempt and every
+// delay of the nested calls is reported up the chain of budgets.
+type nestedBudget struct {
+	mu           sync.Mutex
+	parent       *nestedBudget
+	attemptsLeft uint
+	// sleepLeft is what is left of the WithMaxTotalSleep of the Do owning the
+	// budget, when limitSleep is set.
+	sleepLeft  time.Duration
+	limitSleep bool
+}
+
+func nestedBudgetFromContext(ctx context.Context) *nestedBudget {
+	b, _ := ctx.Value(nestedBudgetKey{}).(*nestedBudget)
+	return b
+}
+
+// chargeAttempt takes one attempt from b and all its parents, or reports
+// false without taking any if one of them has none left.
+func (b *nestedBudget) chargeAttempt() bool {
+	if b.exhausted() {
+		return false
+	}
+	for p := b; p != nil; p = p.parent {
+		p.mu.Lock()
+		if p.attemptsLeft > 0 {
+			p.attemptsLeft--
+		}
+		p.mu.Unlock()
+	}
+	return true
+}
+
+// chargeDelay cuts delay down to the sleep left in b and all its parents,
+// and takes it from each of them.
+func (b *nestedBudget) chargeDelay(delay time.Duration) time.Duration {
+	for p := b; p != nil; p = p.parent {
+		p.mu.Lock()
+		if p.limitSleep && delay > p.sleepLeft {
+			delay = p.sleepLeft
+		}
+		p.mu.Unlock()
+	}
+	for p := b; p != nil; p = p.parent {
+		p.mu.Lock()
+		if p.limitSleep {
+			p.sleepLeft -= delay
+		}
+		p.mu.Unlock()
+	}
+	return delay
+}
+
+func (b *nestedBudget) exhausted() bool {
+	for p := b; p != nil; p = p.parent {
+		p.mu.Lock()
+		left := p.attemptsLeft
+		p.mu.Unlock()
+		if left == 0 {
+			return true
+		}
+	}
+	return false
+}
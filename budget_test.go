@@ -0,0 +1,66 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNestedBudget(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	attempts := uint(5)
+	var outerCalls, innerCalls uint
+	var innerErrs []error
+	err := DoWithContext(ctx, func(ctx context.Context) error {
+		outerCalls++
+		err := Do(func() error {
+			innerCalls++
+			return errors.New("inner error")
+		}, WithContext(ctx), WithAttempts(attempts), WithDelayFn(FixDelayFn, SetFixTimeFn(time.Millisecond)))
+		innerErrs = append(innerErrs, err)
+		return err
+	}, WithAttempts(attempts), WithNestedBudget(true))
+
+	assert.Error(t, err)
+	assert.Equal(t, uint(1), outerCalls, "outer shouldn't retry once the inner Do used up the budget")
+	assert.Equal(t, attempts-1, innerCalls, "inner attempts should count against the outer attempts")
+	assert.Equal(t, attempts, outerCalls+innerCalls, "all attempts together should respect the budget")
+
+	t.Run("exhausted before the nested Do starts", func(t *testing.T) {
+		err := DoWithContext(ctx, func(ctx context.Context) error {
+			return Do(func() error {
+				return nil
+			}, WithContext(ctx))
+		}, WithAttempts(1), WithNestedBudget(true), WithLastErrorOnly(true))
+
+		assert.Equal(t, ErrNestedBudgetExhausted, err)
+	})
+}
+
+func TestNestedBudgetSleep(t *testing.T) {
+	maxSleep := 50 * time.Millisecond
+	var total time.Duration
+	var delays []time.Duration
+	onSleep := WithOnSleepFn(func(attempt uint, sleep time.Duration) {
+		total += sleep
+		delays = append(delays, sleep)
+	})
+	delay := WithDelayFn(FixDelayFn, SetFixTimeFn(20*time.Millisecond))
+
+	var outer DoResult
+	err := DoWithContext(context.Background(), func(ctx context.Context) error {
+		return Do(func() error {
+			return errors.New("inner error")
+		}, WithContext(ctx), WithAttempts(5), delay, onSleep)
+	}, WithAttempts(20), WithNestedBudget(true), WithMaxTotalSleep(maxSleep), delay, onSleep, WithDoResult(&outer))
+	assert.Error(t, err)
+
+	assert.Equal(t, []time.Duration{20 * time.Millisecond, 20 * time.Millisecond, 10 * time.Millisecond}, delays[:3], "the inner delays should be cut to the outer sleep budget")
+	assert.Equal(t, maxSleep, total, "the inner delays should count against the outer sleep budget")
+	assert.True(t, outer.TotalElapsed < 200*time.Millisecond, outer.TotalElapsed.String())
+}
@@ -0,0 +1,36 @@
+package retry
+
+import "context"
+
+// bulkhead holds a concurrency pool per error category, shared by the Do
+// calls using the same WithBulkhead option.
+type bulkhead struct {
+	category func(error) string
+	pools    map[string]chan struct{}
+}
+
+func newBulkhead(category func(error) string, limits map[string]uint) *bulkhead {
+	b := &bulkhead{category: category, pools: make(map[string]chan struct{}, len(limits))}
+	for name, limit := range limits {
+		b.pools[name] = make(chan struct{}, limit)
+	}
+	return b
+}
+
+// acquire takes a slot in the pool of the category of lastErr, waiting for
+// one or for ctx to be done.
+func (b *bulkhead) acquire(ctx context.Context, lastErr error) (release func(), err error) {
+	if lastErr == nil {
+		return func() {}, nil
+	}
+	pool, ok := b.pools[b.category(lastErr)]
+	if !ok {
+		return func() {}, nil
+	}
+	select {
+	case pool <- struct{}{}:
+		return func() { <-pool }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,53 @@
+package retry
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulkhead(t *testing.T) {
+	errDB := errors.New("db")
+	errHTTP := errors.New("http")
+	bulkhead := WithBulkhead(func(err error) string {
+		return err.Error()
+	}, map[string]uint{"db": 1, "http": 3})
+
+	var running, peak [2]int32
+	run := func(i int, err error) {
+		var calls int
+		assert.NoError(t, Do(func() error {
+			calls++
+			if calls == 1 {
+				return err
+			}
+			if cur := atomic.AddInt32(&running[i], 1); cur > atomic.LoadInt32(&peak[i]) {
+				atomic.StoreInt32(&peak[i], cur)
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running[i], -1)
+			return nil
+		}, bulkhead, WithDelayFn(FixDelayFn, SetFixTimeFn(0))))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			run(0, errDB)
+		}()
+		go func() {
+			defer wg.Done()
+			run(1, errHTTP)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&peak[0]), "db retries should run one at a time")
+	assert.LessOrEqual(t, atomic.LoadInt32(&peak[1]), int32(3), "http retries should run at most three at a time")
+}
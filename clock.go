@@ -0,0 +1,25 @@
+package retry
+
+import "time"
+
+// Clock is the source of time of Do, for the delays between attempts and the
+// time based options. Tests can set one moved by hand with WithClock, such as
+// retrytest.FakeClock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c *config) now() time.Time {
+	return c.clock.Now()
+}
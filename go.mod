@@ -1,10 +1,13 @@
 module github.com/nickchenyx/retry-go-dummy
 
-go 1.15
+go 1.21
+
+require github.com/stretchr/testify v1.7.2
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/kr/pretty v0.1.0 // indirect
-	github.com/stretchr/testify v1.7.2
+	github.com/pmezard/go-difflib v1.0.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,21 @@
+package retry
+
+// HealthRegistry tracks the health of endpoints across Do calls, e.g. shared
+// by every client of a service mesh.
+type HealthRegistry interface {
+	// ReportFailure is called for every failed attempt against endpoint.
+	ReportFailure(endpoint string, err error)
+	// IsDown reports whether endpoint should not be retried.
+	IsDown(endpoint string) bool
+}
+
+// reportFailure reports the failure to the health registry, if any, and
+// returns the endpoint it came from.
+func (c *config) reportFailure(err error) string {
+	if c.healthRegistry == nil {
+		return ""
+	}
+	endpoint := c.endpointKey(err)
+	c.healthRegistry.ReportFailure(endpoint, err)
+	return endpoint
+}
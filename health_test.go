@@ -0,0 +1,88 @@
+package retry
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type endpointErr struct{ endpoint string }
+
+func (e endpointErr) Error() string {
+	return "request to " + e.endpoint + " failed"
+}
+
+// fakeRegistry marks an endpoint down after two failures.
+type fakeRegistry struct {
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func (r *fakeRegistry) ReportFailure(endpoint string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures[endpoint]++
+}
+
+func (r *fakeRegistry) IsDown(endpoint string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failures[endpoint] >= 2
+}
+
+func TestEndpointHealth(t *testing.T) {
+	registry := &fakeRegistry{failures: map[string]int{}}
+	endpointKey := func(err error) string {
+		var e endpointErr
+		if errors.As(err, &e) {
+			return e.endpoint
+		}
+		return ""
+	}
+	opts := []Option{WithAttempts(5), WithDelayFn(FixDelayFn, SetFixTimeFn(0)), WithEndpointHealth(registry, endpointKey)}
+
+	var calls int
+	err := Do(func() error {
+		calls++
+		return endpointErr{endpoint: "a"}
+	}, opts...)
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls, "retries should stop once the endpoint is down")
+
+	calls = 0
+	err = Do(func() error {
+		calls++
+		return endpointErr{endpoint: "a"}
+	}, opts...)
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls, "later calls to a down endpoint should fail fast")
+
+	calls = 0
+	err = Do(func() error {
+		calls++
+		if calls < 2 {
+			return endpointErr{endpoint: "b"}
+		}
+		return nil
+	}, opts...)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls, "other endpoints should still be retried")
+}
+
+func TestEndpointHealthReportsEveryFailure(t *testing.T) {
+	registry := &fakeRegistry{failures: map[string]int{}}
+	endpointKey := func(err error) string {
+		return "a"
+	}
+
+	_ = Do(func() error {
+		return UnrecoverableError(errors.New("error"))
+	}, WithEndpointHealth(registry, endpointKey))
+	_ = Do(func() error {
+		return errors.New("error")
+	}, WithRetryIfFn(func(uint, error) bool { return false }), WithEndpointHealth(registry, endpointKey))
+
+	assert.Equal(t, 2, registry.failures["a"], "failures that stop the retries should be reported too")
+}
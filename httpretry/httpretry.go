@@ -0,0 +1,74 @@
+// Package httpretry provides retry predicates for HTTP responses.
+//
+// A request that gets a response never fails, so retrying on the status code
+// goes through the data returned by DoWithData:
+//
+//	resp, err := retry.DoWithData(func() (*http.Response, error) {
+//		return client.Get(url)
+//	}, httpretry.WithRetryOn5xxAnd429())
+package httpretry
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	retry "github.com/nickchenyx/retry-go-dummy"
+)
+
+// RetryOn5xxAnd429 reports whether resp has a transient status: a server
+// error or a 429 Too Many Requests. 501 Not Implemented and 505 HTTP Version
+// Not Supported won't change on a retry and aren't transient.
+func RetryOn5xxAnd429(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	case http.StatusTooManyRequests:
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// WithRetryOn5xxAnd429 makes DoWithData retry the responses RetryOn5xxAnd429
+// rejects. It drains and closes the body of those responses, since DoWithData
+// drops them.
+func WithRetryOn5xxAnd429() retry.Option {
+	return retry.WithResultRetryIf(func(resp *http.Response) bool {
+		if !RetryOn5xxAnd429(resp) {
+			return false
+		}
+		if resp.Body != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		return true
+	})
+}
+
+// RetryAfter wraps err with the delay of the Retry-After header of resp, in
+// seconds or as a date, for retry.RetryAfterDelayFn. err is returned as is
+// when resp has no valid Retry-After header.
+func RetryAfter(resp *http.Response, err error) error {
+	if resp == nil {
+		return err
+	}
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return err
+	}
+	if seconds, parseErr := strconv.Atoi(header); parseErr == nil && seconds >= 0 {
+		return retry.RetryAfter(err, time.Duration(seconds)*time.Second)
+	}
+	if date, parseErr := http.ParseTime(header); parseErr == nil {
+		d := time.Until(date)
+		if d < 0 {
+			d = 0
+		}
+		return retry.RetryAfter(err, d)
+	}
+	return err
+}
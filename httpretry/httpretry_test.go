@@ -0,0 +1,114 @@
+package httpretry
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	retry "github.com/nickchenyx/retry-go-dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryOn5xxAnd429(t *testing.T) {
+	statuses := []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK}
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.WriteHeader(statuses[n-1])
+	}))
+	defer server.Close()
+
+	resp, err := retry.DoWithData(func() (*http.Response, error) {
+		return http.Get(server.URL)
+	}, WithRetryOn5xxAnd429(), retry.WithDelayFn(retry.FixDelayFn, retry.SetFixTimeFn(0)))
+
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestRetryOn5xxAnd429Exhausted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	resp, err := retry.DoWithData(func() (*http.Response, error) {
+		return http.Get(server.URL)
+	}, WithRetryOn5xxAnd429(), retry.WithAttempts(2), retry.WithDelayFn(retry.FixDelayFn, retry.SetFixTimeFn(0)))
+
+	assert.Nil(t, resp)
+	assert.True(t, errors.Is(err, retry.ErrResultRejected))
+}
+
+func TestRetryOn5xxAnd429Statuses(t *testing.T) {
+	for status, retried := range map[int]bool{
+		http.StatusOK:                      false,
+		http.StatusNotFound:                false,
+		http.StatusTooManyRequests:         true,
+		http.StatusInternalServerError:     true,
+		http.StatusBadGateway:              true,
+		http.StatusNotImplemented:          false,
+		http.StatusHTTPVersionNotSupported: false,
+	} {
+		resp := &http.Response{StatusCode: status, Body: http.NoBody}
+		assert.Equal(t, retried, RetryOn5xxAnd429(resp), http.StatusText(status))
+	}
+	assert.False(t, RetryOn5xxAnd429(nil))
+}
+
+type trackedBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestRetryOn5xxAnd429Body(t *testing.T) {
+	body := &trackedBody{Reader: strings.NewReader("unavailable")}
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Body: body}
+	assert.True(t, RetryOn5xxAnd429(resp))
+	assert.False(t, body.closed, "the predicate should leave the body alone")
+
+	var bodies []*trackedBody
+	statuses := []int{http.StatusServiceUnavailable, http.StatusOK}
+	got, err := retry.DoWithData(func() (*http.Response, error) {
+		body := &trackedBody{Reader: strings.NewReader("body")}
+		bodies = append(bodies, body)
+		return &http.Response{StatusCode: statuses[len(bodies)-1], Body: body}, nil
+	}, WithRetryOn5xxAnd429(), retry.WithDelayFn(retry.FixDelayFn, retry.SetFixTimeFn(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, got.StatusCode)
+	assert.True(t, bodies[0].closed, "the body of a retried response should be closed")
+	assert.False(t, bodies[1].closed, "the body of the returned response should be left open")
+}
+
+func TestRetryAfter(t *testing.T) {
+	expectErr := errors.New("429 Too Many Requests")
+	withHeader := func(value string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": []string{value}}}
+	}
+
+	var retryAfter retry.RetryAfterError
+	err := RetryAfter(withHeader("2"), expectErr)
+	assert.True(t, errors.As(err, &retryAfter))
+	assert.Equal(t, 2*time.Second, retryAfter.Duration)
+	assert.True(t, errors.Is(err, expectErr))
+
+	err = RetryAfter(withHeader(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)), expectErr)
+	assert.True(t, errors.As(err, &retryAfter))
+	assert.InDelta(t, float64(time.Minute), float64(retryAfter.Duration), float64(2*time.Second))
+
+	assert.Equal(t, expectErr, RetryAfter(withHeader("soon"), expectErr), "invalid headers should be ignored")
+	assert.Equal(t, expectErr, RetryAfter(&http.Response{}, expectErr))
+	assert.Equal(t, expectErr, RetryAfter(nil, expectErr))
+}
@@ -0,0 +1,53 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	var calls int32
+	err := DoWithContext(context.Background(), func(ctx context.Context) error {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1, 2, 3:
+			return errors.New("error")
+		case 5:
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		return ctx.Err()
+	}, WithParallelism(3))
+	assert.NoError(t, err)
+	assertGoroutinesBackTo(t, before)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_ = DoWithContext(ctx, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, WithParallelism(3), WithOnContextDone(func() {}))
+	assertGoroutinesBackTo(t, before)
+}
+
+// assertGoroutinesBackTo waits for the goroutines that are done to exit and
+// checks that no more than before are left.
+func assertGoroutinesBackTo(t *testing.T, before int) {
+	t.Helper()
+	// assert.Eventually runs its own goroutines, poll by hand instead
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); after > before && time.Now().Before(deadline); after = runtime.NumGoroutine() {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, after <= before, "goroutines should be back to %v, got %v", before, after)
+}
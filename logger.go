@@ -0,0 +1,51 @@
+package retry
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// StructuredLogger receives a message and its fields for every attempt of a
+// Do call. The attempt number and a correlation ID shared by all attempts of
+// the same Do call are always added to the fields.
+type StructuredLogger interface {
+	Log(msg string, fields map[string]interface{})
+}
+
+const (
+	LogFieldAttempt       = "attempt"
+	LogFieldCorrelationID = "retry_id"
+	LogFieldError         = "error"
+	LogFieldName          = "retry_name"
+	LogFieldOperation     = "retry_operation"
+)
+
+type noopLogger struct{}
+
+func (noopLogger) Log(string, map[string]interface{}) {}
+
+var correlationSeq uint64
+
+func nextCorrelationID() string {
+	return strconv.FormatUint(atomic.AddUint64(&correlationSeq, 1), 10)
+}
+
+func (c *config) log(n uint, msg string, err error) {
+	if _, ok := c.logger.(noopLogger); ok {
+		return
+	}
+	fields := map[string]interface{}{
+		LogFieldAttempt:       n,
+		LogFieldCorrelationID: c.correlationID,
+	}
+	if err != nil {
+		fields[LogFieldError] = err
+	}
+	if c.name != "" {
+		fields[LogFieldName] = c.name
+	}
+	if c.operation != "" {
+		fields[LogFieldOperation] = c.operation
+	}
+	c.logger.Log(msg, fields)
+}
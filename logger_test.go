@@ -0,0 +1,67 @@
+package retry
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingLogger struct {
+	mu     sync.Mutex
+	msgs   []string
+	fields []map[string]interface{}
+}
+
+func (l *recordingLogger) Log(msg string, fields map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+	l.fields = append(l.fields, fields)
+}
+
+func TestStructuredLoggerFields(t *testing.T) {
+	logger := &recordingLogger{}
+	var calls int
+	err := Do(func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("error")
+		}
+		return nil
+	}, WithStructuredLogger(logger))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"attempt failed", "attempt failed", "attempt succeeded"}, logger.msgs)
+	id := logger.fields[0][LogFieldCorrelationID]
+	assert.NotEmpty(t, id)
+	for i, fields := range logger.fields {
+		assert.Equal(t, id, fields[LogFieldCorrelationID], "log lines of one Do should share the correlation id")
+		assert.Equal(t, uint(i), fields[LogFieldAttempt], "attempt numbers should increase")
+	}
+	assert.EqualError(t, logger.fields[0][LogFieldError].(error), "error")
+
+	other := &recordingLogger{}
+	_ = Do(func() error { return nil }, WithStructuredLogger(other))
+	assert.NotEqual(t, id, other.fields[0][LogFieldCorrelationID], "each Do should get its own correlation id")
+}
+
+func TestStructuredLoggerName(t *testing.T) {
+	logger := &recordingLogger{}
+	err := Do(func() error {
+		return errors.New("error")
+	}, WithStructuredLogger(logger), WithName("db"), WithAttempts(2))
+
+	expectedErr := `Retry Error [db]: 
+# 0: error
+# 1: error`
+	assert.EqualError(t, err, expectedErr)
+	for _, fields := range logger.fields {
+		assert.Equal(t, "db", fields[LogFieldName])
+	}
+
+	unnamed := &recordingLogger{}
+	_ = Do(func() error { return nil }, WithStructuredLogger(unnamed))
+	assert.NotContains(t, unnamed.fields[0], LogFieldName)
+}
@@ -0,0 +1,88 @@
+package retry
+
+import "reflect"
+
+// Matcher is a compiled form of the target lists of WithRetryOnErrors and
+// WithAbortOnErrors, built once with CompileMatcher and shared by many Do
+// calls with WithMatcher. It matches like errors.Is, looking the errors up in
+// a set instead of trying every target in turn.
+type Matcher struct {
+	retryOn errorSet
+	abortOn errorSet
+}
+
+// CompileMatcher returns a Matcher retrying only the errors matching one of
+// retryOn, all of them when it is empty, and stopping on the errors matching
+// one of abortOn.
+func CompileMatcher(retryOn []error, abortOn []error) *Matcher {
+	return &Matcher{retryOn: newErrorSet(retryOn), abortOn: newErrorSet(abortOn)}
+}
+
+func (m *Matcher) allows(err error) bool {
+	if !m.retryOn.empty() && !m.retryOn.matches(err) {
+		return false
+	}
+	return !m.abortOn.matches(err)
+}
+
+type errorSet struct {
+	// comparable targets are looked up, the others are compared with
+	// errors.Is
+	set   map[error]struct{}
+	other []error
+}
+
+func newErrorSet(targets []error) errorSet {
+	s := errorSet{set: make(map[error]struct{}, len(targets))}
+	for _, target := range targets {
+		if target == nil {
+			continue
+		}
+		if reflect.TypeOf(target).Comparable() {
+			s.set[target] = struct{}{}
+		} else {
+			s.other = append(s.other, target)
+		}
+	}
+	return s
+}
+
+func (s errorSet) empty() bool {
+	return len(s.set) == 0 && len(s.other) == 0
+}
+
+func (s errorSet) matches(err error) bool {
+	return s.matchesChain(err) || isAny(err, s.other)
+}
+
+// matchesChain walks the tree of err like errors.Is does.
+func (s errorSet) matchesChain(err error) bool {
+	for err != nil {
+		if reflect.TypeOf(err).Comparable() {
+			if _, ok := s.set[err]; ok {
+				return true
+			}
+		}
+		if x, ok := err.(interface{ Is(error) bool }); ok {
+			for target := range s.set {
+				if x.Is(target) {
+					return true
+				}
+			}
+		}
+		switch x := err.(type) {
+		case interface{ Unwrap() error }:
+			err = x.Unwrap()
+		case interface{ Unwrap() []error }:
+			for _, err := range x.Unwrap() {
+				if s.matchesChain(err) {
+					return true
+				}
+			}
+			return false
+		default:
+			return false
+		}
+	}
+	return false
+}
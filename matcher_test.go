@@ -0,0 +1,77 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type isTimeoutErr struct{}
+
+func (isTimeoutErr) Error() string { return "i/o timeout" }
+
+func (isTimeoutErr) Is(target error) bool { return target == errTimeout }
+
+var errTimeout = errors.New("timeout")
+
+type sliceErr []string
+
+func (e sliceErr) Error() string { return fmt.Sprint([]string(e)) }
+
+func TestMatcher(t *testing.T) {
+	errThrottled := errors.New("throttled")
+	errForbidden := errors.New("forbidden")
+	unhashable := sliceErr{"unhashable"}
+	m := CompileMatcher([]error{errThrottled, errTimeout, unhashable}, []error{errForbidden})
+
+	for err, allowed := range map[error]bool{
+		errThrottled:                                   true,
+		fmt.Errorf("call: %w", errThrottled):           true,
+		errors.Join(errors.New("other"), errThrottled): true,
+		isTimeoutErr{}:                                 true,
+		fmt.Errorf("call: %w", isTimeoutErr{}):         true,
+		errors.New("other"):                            false,
+		errors.Join(errThrottled, errForbidden):        false,
+		fmt.Errorf("call: %w", errForbidden):           false,
+	} {
+		assert.Equal(t, allowed, m.allows(err), err.Error())
+	}
+	wrapped := fmt.Errorf("call: %w", unhashable)
+	assert.Equal(t, errors.Is(wrapped, unhashable), m.allows(wrapped), "should handle errors that can't be map keys like errors.Is")
+	assert.True(t, CompileMatcher(nil, []error{errForbidden}).allows(errors.New("other")), "should retry everything without retry targets")
+
+	var calls int
+	err := Do(func() error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("call: %w", errThrottled)
+		}
+		return errForbidden
+	}, WithMatcher(m), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+	assert.True(t, errors.Is(err, errForbidden))
+	assert.Equal(t, 3, calls, "should stop on the abort target")
+}
+
+func BenchmarkMatcher(b *testing.B) {
+	var targets []error
+	for i := 0; i < 100; i++ {
+		targets = append(targets, fmt.Errorf("sentinel %d", i))
+	}
+	err := fmt.Errorf("call: %w", targets[len(targets)-1])
+
+	b.Run("errors.Is", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = isAny(err, targets)
+		}
+	})
+
+	b.Run("compiled", func(b *testing.B) {
+		m := CompileMatcher(targets, nil)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = m.allows(err)
+		}
+	})
+}
@@ -0,0 +1,31 @@
+// Package netretry provides retry predicates for transient network errors.
+package netretry
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	retry "github.com/nickchenyx/retry-go-dummy"
+)
+
+// IsTransientNetworkError reports whether err, or any error it wraps, is a
+// network timeout, a reset or refused connection, or an unexpected EOF.
+func IsTransientNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// WithRetryOnTransientNetwork retries only transient network errors that
+// are not marked unrecoverable.
+func WithRetryOnTransientNetwork() retry.Option {
+	return retry.WithRetryIfFn(func(n uint, err error) bool {
+		return !retry.IsUnrecoverableError(err) && IsTransientNetworkError(err)
+	})
+}
@@ -0,0 +1,58 @@
+package netretry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	retry "github.com/nickchenyx/retry-go-dummy"
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutErr struct{ timeout bool }
+
+func (e timeoutErr) Error() string   { return "timeout" }
+func (e timeoutErr) Timeout() bool   { return e.timeout }
+func (e timeoutErr) Temporary() bool { return false }
+
+func TestIsTransientNetworkError(t *testing.T) {
+	transient := []error{
+		timeoutErr{timeout: true},
+		&net.OpError{Op: "dial", Net: "tcp", Err: timeoutErr{timeout: true}},
+		&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+		&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+		io.ErrUnexpectedEOF,
+	}
+	for _, err := range transient {
+		wrapped := fmt.Errorf("call failed: %w", err)
+		assert.True(t, IsTransientNetworkError(wrapped), fmt.Sprintf("%v should be transient", wrapped))
+	}
+
+	permanent := []error{
+		timeoutErr{timeout: false},
+		io.EOF,
+		errors.New("error"),
+	}
+	for _, err := range permanent {
+		wrapped := fmt.Errorf("call failed: %w", err)
+		assert.False(t, IsTransientNetworkError(wrapped), fmt.Sprintf("%v shouldn't be transient", wrapped))
+	}
+}
+
+func TestWithRetryOnTransientNetwork(t *testing.T) {
+	var calls int
+	err := retry.Do(func() error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("read: %w", io.ErrUnexpectedEOF)
+		}
+		return errors.New("bad request")
+	}, WithRetryOnTransientNetwork(), retry.WithLastErrorOnly(true))
+
+	assert.EqualError(t, err, "bad request")
+	assert.Equal(t, 3, calls, "should retry transient errors and stop on the others")
+}
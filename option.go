@@ -2,8 +2,13 @@ package retry
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math"
 	"math/rand"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -13,22 +18,44 @@ type DelayOption func(*config)
 
 type OnRetryFn func(uint, error)
 
+// RetryIfFn gets the error exactly as f returned it, still wrapped by
+// UnrecoverableError if it was, so IsUnrecoverableError works on it. Only
+// the errors kept in Error are unwrapped.
 type RetryIfFn func(uint, error) bool
 
+type RetryIfWithDurationFn func(uint, error, time.Duration) bool
+
+type RetryDecision int
+
+const (
+	// Stop gives up retrying.
+	Stop RetryDecision = iota
+	// RetryWithDelay retries after the configured delay.
+	RetryWithDelay
+	// RetryNow retries right away, skipping the delay.
+	RetryNow
+)
+
+type RetryDecisionFn func(uint, error) RetryDecision
+
 type DelayFn func(uint, error, *config) time.Duration
 
-type JitterFn func(uint, error) time.Duration
+// JitterFn returns the random time WithJitter adds to the delay computed for
+// attempt n.
+type JitterFn func(n uint, delay time.Duration, c *config) time.Duration
 
 var (
 	defaultAttempts  = uint(10)
 	defaultOnRetryFn = func(n uint, err error) {}
 	defaultRetryIfFn = func(n uint, err error) bool {
-		return !IsReconverableError(err)
+		return !IsUnrecoverableError(err)
+	}
+	defaultRetryIfWithDurationFn = func(n uint, err error, d time.Duration) bool {
+		return true
 	}
 	defaultDelayFn = func(n uint, err error, c *config) time.Duration {
 		return time.Duration(0)
 	}
-	defaultJitterTime = time.Duration(100 * time.Millisecond)
 )
 
 func SetMaxDelayTimeFn(maxDelayTime time.Duration) DelayOption {
@@ -54,7 +81,7 @@ func SetRamdomTimeFn(randomTime time.Duration) DelayOption {
 }
 
 func RandomDelayFn(n uint, err error, c *config) time.Duration {
-	return time.Duration(rand.Int63n(int64(c.randomTime)))
+	return time.Duration(c.randInt63n(int64(c.randomTime)))
 }
 
 func SetBackOffBeginTimeFn(backOffBeginTime time.Duration) DelayOption {
@@ -63,6 +90,21 @@ func SetBackOffBeginTimeFn(backOffBeginTime time.Duration) DelayOption {
 	}
 }
 
+// SetBackOffFactorRangeFn makes BackOffDelayFn multiply the previous delay
+// by a factor picked at random in [min, max] at every step instead of
+// doubling it, e.g. 1.8 to 2.2, to keep a fleet of clients from backing off in
+// sync. The delays never shrink and stop growing at the max delay time. It
+// panics unless 1 <= min <= max.
+func SetBackOffFactorRangeFn(min, max float64) DelayOption {
+	if min < 1 || min > max {
+		panic(fmt.Sprintf("retry: invalid backoff factor range [%v, %v]", min, max))
+	}
+	return func(c *config) {
+		c.backOffFactorMin = min
+		c.backOffFactorMax = max
+	}
+}
+
 func BackOffDelayFn(n uint, err error, c *config) time.Duration {
 	// 1 << 63 overflow signed int64
 	max := uint(62)
@@ -70,6 +112,10 @@ func BackOffDelayFn(n uint, err error, c *config) time.Duration {
 		c.delayTime = 1
 	}
 
+	if c.backOffFactorMax > 0 {
+		return c.factorBackOff(n)
+	}
+
 	if c.maxBackOffN == 0 {
 		c.maxBackOffN = max - uint(math.Floor(math.Log2(float64(c.delayTime))))
 	}
@@ -81,25 +127,373 @@ func BackOffDelayFn(n uint, err error, c *config) time.Duration {
 	return c.delayTime << n
 }
 
+// factorBackOff grows the delay of the previous step by a fresh random factor
+// up to step n, starting over from the base when the steps don't follow.
+func (c *config) factorBackOff(n uint) time.Duration {
+	if n == 0 || n <= c.backOffStep || c.backOffPrev == 0 {
+		c.backOffPrev, c.backOffStep = c.delayTime, 0
+	}
+	for c.backOffStep < n {
+		factor := c.backOffFactorMin + c.randFloat64()*(c.backOffFactorMax-c.backOffFactorMin)
+		delayTime := float64(c.backOffPrev) * factor
+		if delayTime >= float64(c.maxDelayTime) {
+			delayTime = float64(c.maxDelayTime)
+		}
+		c.backOffPrev = time.Duration(delayTime)
+		c.backOffStep++
+	}
+	return c.backOffPrev
+}
+
+// ExponentialBackoffWithJitterFn waits a random time below the delay of
+// BackOffDelayFn, base*2^n with the base set by SetBackOffBeginTimeFn, capped
+// at SetMaxDelayTimeFn. This "full jitter" backoff is a good default for most
+// retries, without combining a DelayFn with WithJitter.
+func ExponentialBackoffWithJitterFn(n uint, err error, c *config) time.Duration {
+	delayTime := BackOffDelayFn(n, err, c)
+	if delayTime > c.maxDelayTime {
+		delayTime = c.maxDelayTime
+	}
+	return FullJitterFn(n, delayTime, c)
+}
+
+// RetryAfterDelayFn waits for the Duration of a RetryAfterError, the delay
+// suggested by the server, and otherwise for the delay of fallback.
+func RetryAfterDelayFn(fallback DelayFn) DelayFn {
+	return func(n uint, err error, c *config) time.Duration {
+		var retryAfter RetryAfterError
+		if errors.As(err, &retryAfter) {
+			return retryAfter.Duration
+		}
+		return fallback(n, err, c)
+	}
+}
+
+// QueueDepthDelayFn waits perUnit for every request queued on the server,
+// as reported by depth from the error, capped at the max delay time. Errors
+// without a positive depth get no delay.
+func QueueDepthDelayFn(depth func(error) int, perUnit time.Duration) DelayFn {
+	return func(n uint, err error, c *config) time.Duration {
+		d := depth(err)
+		if d <= 0 {
+			return 0
+		}
+		if perUnit > 0 && time.Duration(d) > c.maxDelayTime/perUnit {
+			return c.maxDelayTime
+		}
+		return time.Duration(d) * perUnit
+	}
+}
+
+// AbsoluteTimeDelayFn waits until the absolute "retry at" time extracted from
+// the error, shifted by skew to correct for the difference between the
+// server's clock and ours. Errors without a timestamp get no delay.
+func AbsoluteTimeDelayFn(extract func(error) (time.Time, bool), skew time.Duration) DelayFn {
+	return func(n uint, err error, c *config) time.Duration {
+		target, ok := extract(err)
+		if !ok {
+			return 0
+		}
+		delayTime := target.Sub(c.now()) + skew
+		if delayTime < 0 {
+			return 0
+		}
+		return delayTime
+	}
+}
+
+// AlignedDelayFn waits until the next wall-clock multiple of boundary, e.g.
+// the next :00 or :30 second for a 30s boundary.
+func AlignedDelayFn(boundary time.Duration) DelayFn {
+	return func(n uint, err error, c *config) time.Duration {
+		now := c.now()
+		return now.Truncate(boundary).Add(boundary).Sub(now)
+	}
+}
+
+// WindowedBackoffDelayFn waits perFailure for every failure seen in the last
+// window. Each call records a failure, and the failures are kept in the
+// returned DelayFn, so reusing it across Do calls backs off on the failure
+// density of all of them.
+func WindowedBackoffDelayFn(window time.Duration, perFailure time.Duration) DelayFn {
+	var mu sync.Mutex
+	var failures []time.Time
+	return func(n uint, err error, c *config) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := c.now()
+		failures = append(failures, now)
+		cutoff := now.Add(-window)
+		i := 0
+		for i < len(failures) && !failures[i].After(cutoff) {
+			i++
+		}
+		failures = failures[i:]
+		return time.Duration(len(failures)) * perFailure
+	}
+}
+
+// DeadlineFractionDelayFn waits fraction of the time left before the context
+// deadline, give or take jitter times that, so the delays shrink along with
+// the budget. It doesn't wait without a deadline.
+func DeadlineFractionDelayFn(fraction float64, jitter float64) DelayFn {
+	return func(n uint, err error, c *config) time.Duration {
+		deadline, ok := c.ctx.Deadline()
+		if !ok {
+			return 0
+		}
+		delayTime := float64(deadline.Sub(c.now())) * fraction * (1 + jitter*(2*c.randFloat64()-1))
+		if delayTime < 0 {
+			return 0
+		}
+		return time.Duration(delayTime)
+	}
+}
+
+// LastChanceDelayFn drops the delay computed by df to zero when less than
+// twice that delay is left before the context deadline, squeezing in a last
+// attempt right away instead of sleeping into the deadline.
+func LastChanceDelayFn(df DelayFn) DelayFn {
+	return func(n uint, err error, c *config) time.Duration {
+		delayTime := df(n, err, c)
+		if deadline, ok := c.ctx.Deadline(); ok && deadline.Sub(c.now()) < 2*delayTime {
+			return 0
+		}
+		return delayTime
+	}
+}
+
+// FibonacciDelayFn waits base * fib(n+1) after attempt n, so 1, 1, 2, 3, 5,
+// 8... times the base set by SetFixTimeFn. Delays that would overflow are
+// clamped to the max delay time.
+func FibonacciDelayFn(n uint, err error, c *config) time.Duration {
+	if c.delayTime <= 0 {
+		return 0
+	}
+	// the last two terms are kept between calls, as n usually just grows by 1
+	if c.fibCur == 0 || n < c.fibN {
+		c.fibPrev, c.fibCur, c.fibN = 0, 1, 0
+	}
+	for ; c.fibN < n; c.fibN++ {
+		if c.fibCur > uint64(math.MaxInt64/c.delayTime) {
+			return c.maxDelayTime
+		}
+		c.fibPrev, c.fibCur = c.fibCur, c.fibPrev+c.fibCur
+	}
+	if c.fibCur > uint64(math.MaxInt64/c.delayTime) {
+		return c.maxDelayTime
+	}
+	return c.delayTime * time.Duration(c.fibCur)
+}
+
+// GoogleTruncatedExponentialDelayFn waits (2^n - 1) * base plus a random
+// time up to SetRamdomTimeFn, truncated at the max delay time, as recommended
+// by Google Cloud. The base is set by SetBackOffBeginTimeFn.
+func GoogleTruncatedExponentialDelayFn(n uint, err error, c *config) time.Duration {
+	delayTime := c.maxDelayTime
+	if c.delayTime <= 0 {
+		delayTime = 0
+	} else if n < 63 && uint64(1)<<n-1 <= uint64(math.MaxInt64/c.delayTime) {
+		delayTime = c.delayTime * time.Duration(uint64(1)<<n-1)
+	}
+	var random time.Duration
+	if c.randomTime > 0 {
+		random = time.Duration(c.randInt63n(int64(c.randomTime)))
+	}
+	if delayTime > c.maxDelayTime-random {
+		return c.maxDelayTime
+	}
+	return delayTime + random
+}
+
+// RampUpDownDelayFn doubles the delay from the base set by
+// SetBackOffBeginTimeFn until attempt peakAttempt, then halves it back down to
+// the base, in case the earlier failures were a spike that has passed.
+func RampUpDownDelayFn(peakAttempt uint) DelayFn {
+	return func(n uint, err error, c *config) time.Duration {
+		exponent := n
+		if n > peakAttempt {
+			exponent = 0
+			if n < 2*peakAttempt {
+				exponent = 2*peakAttempt - n
+			}
+		}
+		if c.delayTime <= 0 {
+			return 0
+		}
+		// 1 << 63 overflow signed int64
+		if maxExponent := 62 - uint(math.Floor(math.Log2(float64(c.delayTime)))); exponent > maxExponent {
+			exponent = maxExponent
+		}
+		return c.delayTime << exponent
+	}
+}
+
+// LinearDelayFn waits base * (n+1) after attempt n, with the base set by
+// SetFixTimeFn.
+func LinearDelayFn(n uint, err error, c *config) time.Duration {
+	if c.delayTime > 0 && uint64(n)+1 > uint64(math.MaxInt64/c.delayTime) {
+		return time.Duration(math.MaxInt64)
+	}
+	return c.delayTime * time.Duration(n+1)
+}
+
+// PolynomialDelayFn grows the delay as base * n^power, with the base set by
+// SetFixTimeFn: a middle ground between linear and exponential backoff.
+func PolynomialDelayFn(power float64) DelayFn {
+	return func(n uint, err error, c *config) time.Duration {
+		delayTime := float64(c.delayTime) * math.Pow(float64(n), power)
+		if delayTime >= math.MaxInt64 {
+			return time.Duration(math.MaxInt64)
+		}
+		return time.Duration(delayTime)
+	}
+}
+
+// CronSchedule gives the scheduled instants retries are allowed at, e.g. a
+// parsed cron expression.
+type CronSchedule interface {
+	Next(after time.Time) time.Time
+}
+
+// CronDelayFn waits until the next instant of schedule.
+func CronDelayFn(schedule CronSchedule) DelayFn {
+	return func(n uint, err error, c *config) time.Duration {
+		now := c.now()
+		delayTime := schedule.Next(now).Sub(now)
+		if delayTime < 0 {
+			return 0
+		}
+		return delayTime
+	}
+}
+
+func SetDecorrelatedBaseFn(base time.Duration) DelayOption {
+	return func(c *config) {
+		c.decorrelatedBase = base
+	}
+}
+
+// DecorrelatedJitterDelayFn waits a random time between the base set by
+// SetDecorrelatedBaseFn and three times the previous delay, capped at the max
+// delay time, following the "decorrelated jitter" algorithm.
+func DecorrelatedJitterDelayFn(n uint, err error, c *config) time.Duration {
+	base := c.decorrelatedBase
+	prev := c.lastSleep
+	if n == 0 || prev < base {
+		prev = base
+	}
+	upper := time.Duration(math.MaxInt64)
+	if prev <= upper/3 {
+		upper = prev * 3
+	}
+	delayTime := base
+	if upper > base {
+		delayTime += time.Duration(c.randInt63n(int64(upper - base)))
+	}
+	if delayTime > c.maxDelayTime {
+		delayTime = c.maxDelayTime
+	}
+	c.lastSleep = delayTime
+	return delayTime
+}
+
+// FullJitterFn is a JitterFn adding a random time in [0, delay).
+func FullJitterFn(n uint, delay time.Duration, c *config) time.Duration {
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(c.randInt63n(int64(delay)))
+}
+
+// EqualJitterFn is a JitterFn adding half the delay plus a random time in
+// [0, delay/2).
+func EqualJitterFn(n uint, delay time.Duration, c *config) time.Duration {
+	half := delay / 2
+	if half <= 0 {
+		return half
+	}
+	return half + time.Duration(c.randInt63n(int64(half)))
+}
+
+// GaussianJitterFn returns a DelayFn that adds a normally distributed offset
+// with the given stddev to the base delay (SetFixTimeFn), clamped at zero.
+func GaussianJitterFn(stddev time.Duration) DelayFn {
+	return func(n uint, err error, c *config) time.Duration {
+		delay := c.delayTime + time.Duration(c.randNormFloat64()*float64(stddev))
+		if delay < 0 {
+			return 0
+		}
+		return delay
+	}
+}
+
 func CombineDelayFn(delayFns ...DelayFn) DelayFn {
+	return CombineDelayFnMode(CombineSum, delayFns...)
+}
+
+// CombineMode tells how CombineDelayFnMode combines the delays of its
+// DelayFns.
+type CombineMode int
+
+const (
+	// CombineSum waits for the sum of the delays, like CombineDelayFn.
+	CombineSum CombineMode = iota
+	// CombineMax waits for the longest delay, e.g. to honor whichever of a
+	// Retry-After hint and a local backoff is larger.
+	CombineMax
+	// CombineMin waits for the shortest delay.
+	CombineMin
+)
+
+// CombineDelayFnMode combines the delays of delayFns according to mode.
+func CombineDelayFnMode(mode CombineMode, delayFns ...DelayFn) DelayFn {
 	return func(n uint, e error, c *config) time.Duration {
 		var duration time.Duration
-		for _, df := range delayFns {
-			duration += df(n, e, c)
+		for i, df := range delayFns {
+			d := df(n, e, c)
+			switch {
+			case mode == CombineSum:
+				duration += d
+			case i == 0,
+				mode == CombineMax && d > duration,
+				mode == CombineMin && d < duration:
+				duration = d
+			}
 		}
 		return duration
 	}
 }
 
+// MaxDelayFn waits for the longest of the delays of delayFns, e.g. a computed
+// backoff with a floor.
+func MaxDelayFn(delayFns ...DelayFn) DelayFn {
+	return CombineDelayFnMode(CombineMax, delayFns...)
+}
+
+// MinDelayFn waits for the shortest of the delays of delayFns.
+func MinDelayFn(delayFns ...DelayFn) DelayFn {
+	return CombineDelayFnMode(CombineMin, delayFns...)
+}
+
 func WithDelayFn(df DelayFn, opts ...DelayOption) Option {
 	return func(c *config) {
 		for _, opt := range opts {
 			opt(c)
 		}
+		c.baseDelayFn = df
 		c.delayFn = func(n uint, e error, c *config) time.Duration {
 			delayTime := df(n, e, c)
-			if delayTime > c.maxDelayTime {
-				return c.maxDelayTime
+			c.rawDelay = delayTime
+			// scale before clamping, the multiplier must not push past the max
+			delayTime = c.scaleDelay(delayTime)
+			maxDelayTime := c.maxDelayTime
+			if c.maxDelayFn != nil {
+				maxDelayTime = c.maxDelayFn(n)
+			}
+			if delayTime > maxDelayTime {
+				return c.smoothCap(maxDelayTime)
 			}
 			return delayTime
 		}
@@ -107,12 +501,104 @@ func WithDelayFn(df DelayFn, opts ...DelayOption) Option {
 	}
 }
 
+// WithCapSmoothing applies a random ±fraction jitter to delays clamped to the
+// max delay time, so clients stuck at the cap don't retry in lockstep.
+func WithCapSmoothing(fraction float64) Option {
+	return func(c *config) {
+		c.capSmoothing = fraction
+	}
+}
+
+func (c *config) smoothCap(maxDelayTime time.Duration) time.Duration {
+	if c.capSmoothing <= 0 {
+		return maxDelayTime
+	}
+	offset := c.capSmoothing * (2*c.randFloat64() - 1)
+	return time.Duration(float64(maxDelayTime) * (1 + offset))
+}
+
+// WithBackoffByClassifier picks the DelayFn for every retry from backoffs by
+// the bucket classify puts the error in. Errors in buckets without a DelayFn
+// keep using the delay configured before this option.
+func WithBackoffByClassifier(classify func(error) string, backoffs map[string]DelayFn, opts ...DelayOption) Option {
+	return func(c *config) {
+		// the scaling and clamping of WithDelayFn apply to the fallback once
+		fallback := c.baseDelayFn
+		WithDelayFn(func(n uint, e error, c *config) time.Duration {
+			if df, ok := backoffs[classify(e)]; ok {
+				return df(n, e, c)
+			}
+			return fallback(n, e, c)
+		}, opts...)(c)
+	}
+}
+
+// WithAutoBackoff configures exponential backoff to fit totalDeadline: it
+// starts at 1/100 of the deadline, is capped at 1/4 of it, and gets as many
+// attempts as the sum of the delays between them fits in the deadline. The
+// time spent in the attempts themselves is not accounted for. A deadline too
+// short for any delay leaves a single attempt.
+func WithAutoBackoff(totalDeadline time.Duration) Option {
+	return func(c *config) {
+		maxDelayTime := totalDeadline / 4
+		if maxDelayTime <= 0 {
+			c.attempts = 1
+			return
+		}
+		base := totalDeadline / 100
+		if base <= 0 {
+			base = 1
+		}
+
+		attempts := uint(1)
+		var total time.Duration
+		for delayTime := base; ; attempts++ {
+			if delayTime > maxDelayTime {
+				delayTime = maxDelayTime
+			}
+			if total+delayTime > totalDeadline {
+				break
+			}
+			total += delayTime
+			delayTime *= 2
+		}
+
+		c.attempts = attempts
+		WithDelayFn(BackOffDelayFn, SetBackOffBeginTimeFn(base), SetMaxDelayTimeFn(maxDelayTime))(c)
+	}
+}
+
+// WithEnvDelayMultiplier multiplies every delay by the float read from the
+// environment variable varName, to inject latency in chaos tests without
+// touching the call sites. The max delay still caps the multiplied delays. A
+// missing or unparsable value counts as 1.
+func WithEnvDelayMultiplier(varName string) Option {
+	return func(c *config) {
+		multiplier, err := strconv.ParseFloat(os.Getenv(varName), 64)
+		if err != nil || multiplier < 0 {
+			multiplier = 1
+		}
+		c.delayMultiplier = multiplier
+	}
+}
+
 func WithContext(ctx context.Context) Option {
 	return func(c *config) {
 		c.ctx = ctx
 	}
 }
 
+// WithOnContextDone registers fn to run, in its own goroutine, if the context
+// is done while Do is still running. Do waits for a started fn to return
+// before returning itself, so fn never runs once Do has returned.
+func WithOnContextDone(fn func()) Option {
+	return func(c *config) {
+		c.onContextDone = fn
+	}
+}
+
+// WithAttempts sets how many times f is called at most. 0 means retrying
+// until f succeeds, returns an unrecoverable error or the context is done.
 func WithAttempts(attempts uint) Option {
 	return func(c *config) {
 		c.attempts = attempts
@@ -131,6 +617,540 @@ func WithRetryIfFn(retryIfFn RetryIfFn) Option {
 	}
 }
 
+// WithRetryIfWithDurationFn adds a predicate that also receives how long the
+// failed attempt took. It is checked after the RetryIfFn and both must agree
+// to retry.
+func WithRetryIfWithDurationFn(retryIfWithDurationFn RetryIfWithDurationFn) Option {
+	return func(c *config) {
+		c.retryIfWithDurationFn = retryIfWithDurationFn
+	}
+}
+
+// WithParallelism runs k copies of f concurrently in every attempt. The
+// attempt succeeds as soon as one copy succeeds, and the remaining copies are
+// cancelled through the context given to f by DoWithContext.
+func WithParallelism(k uint) Option {
+	return func(c *config) {
+		c.parallelism = k
+	}
+}
+
+// WithBarrier makes Do wait at b before every attempt, so that Do calls
+// sharing the barrier advance through their attempts in lockstep. Do leaves
+// b when it returns, so a call that succeeds or gives up early doesn't block
+// the others.
+func WithBarrier(b Barrier) Option {
+	return func(c *config) {
+		c.barrier = b
+	}
+}
+
+// WithStopOnRepeatedError stops retrying once the same error, compared by
+// errors.Is, has occurred threshold times in total, whatever the RetryIfFn
+// says. The occurrences don't have to be consecutive.
+func WithStopOnRepeatedError(threshold uint) Option {
+	return func(c *config) {
+		c.stopOnRepeated = threshold
+	}
+}
+
+func WithStructuredLogger(logger StructuredLogger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+func WithDoResult(result *DoResult) Option {
+	return func(c *config) {
+		c.result = result
+	}
+}
+
+// WithOneBasedAttempts makes attempt numbers start at 1 instead of 0 in
+// callbacks, log fields and the Error message. DelayFns still get the 0-based
+// attempt.
+func WithOneBasedAttempts(oneBased bool) Option {
+	return func(c *config) {
+		c.oneBasedAttempts = oneBased
+	}
+}
+
+// WithPauseSignal holds retries while paused returns true, e.g. during a
+// maintenance window. It is checked before every delay and Do resumes once it
+// returns false again, unless the context is done first.
+func WithPauseSignal(paused func() bool) Option {
+	return func(c *config) {
+		c.pauseSignal = paused
+	}
+}
+
+// WithRetryDecisionFn decides after every failed attempt whether to stop,
+// retry after the delay, or retry immediately. It replaces the RetryIfFn.
+func WithRetryDecisionFn(retryDecisionFn RetryDecisionFn) Option {
+	return func(c *config) {
+		c.retryDecisionFn = retryDecisionFn
+	}
+}
+
+// WithErrorSummaryOnly keeps only the first and the last error instead of one
+// per attempt, plus how many attempts failed, to bound memory for a large
+// number of attempts.
+func WithErrorSummaryOnly(summaryOnly bool) Option {
+	return func(c *config) {
+		c.errorSummaryOnly = summaryOnly
+	}
+}
+
+// WithInjectFailures is a test seam: the first failUntilAttempt calls of f
+// are treated as if they returned injected, whatever they actually returned,
+// to exercise the failure path of code using Do.
+func WithInjectFailures(failUntilAttempt uint, injected error) Option {
+	return func(c *config) {
+		c.injectFailuresUntil = failUntilAttempt
+		c.injectedErr = injected
+	}
+}
+
+// WithName labels the retries so they can be told apart in log fields and in
+// the Error message.
+func WithName(name string) Option {
+	return func(c *config) {
+		c.name = name
+	}
+}
+
+// WithAttemptTimeout gives every attempt a timeout of d on the context passed
+// to f by DoWithContext. An attempt running out of time fails like any other
+// and is retried.
+func WithAttemptTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.attemptTimeoutFn = func(uint) time.Duration {
+			return d
+		}
+	}
+}
+
+// WithEscalatingAttemptTimeout gives attempt n a timeout of base * factor^n on
+// the context passed to f by DoWithContext, so later attempts get more time.
+func WithEscalatingAttemptTimeout(base time.Duration, factor float64) Option {
+	return func(c *config) {
+		c.attemptTimeoutFn = func(n uint) time.Duration {
+			timeout := float64(base) * math.Pow(factor, float64(n))
+			if timeout >= math.MaxInt64 {
+				return time.Duration(math.MaxInt64)
+			}
+			return time.Duration(timeout)
+		}
+	}
+}
+
+// WithErrorSampleRate keeps only the error of every Nth attempt, plus always
+// the first and the last one, to bound memory for a huge number of attempts.
+// Error.Attempts still reports how many attempts failed.
+func WithErrorSampleRate(everyN uint) Option {
+	return func(c *config) {
+		c.errorSampleEvery = everyN
+	}
+}
+
+// WithNestedBudget makes the attempts of Do calls nested in f count against
+// this Do's attempts, as long as they run with the context passed to f by
+// DoWithContext. The nested calls report every attempt up through the context
+// and stop once the shared attempts are used up, so retries nested in retries
+// can't multiply past the outer budget. Their delays likewise count against
+// the WithMaxTotalSleep of this Do.
+func WithNestedBudget(nested bool) Option {
+	return func(c *config) {
+		c.nestedBudget = nested
+	}
+}
+
+// WithBatchAbortIfFailureRate makes DoAll stop retrying its remaining items
+// once more than fraction of the completed items failed, after at least
+// minSamples items completed. It has no effect outside DoAll.
+func WithBatchAbortIfFailureRate(fraction float64, minSamples uint) Option {
+	return func(c *config) {
+		c.batchAbortFraction = fraction
+		c.batchAbortMinSamples = minSamples
+	}
+}
+
+// WithSingleFlight makes concurrent Do or DoWithData calls with the same key
+// and group share a single retry loop, for expensive idempotent reads. Callers
+// that join an in-flight call get its data and error, so f must not depend on
+// anything specific to one caller.
+func WithSingleFlight(key string, group *Group) Option {
+	return func(c *config) {
+		c.singleFlightKey = key
+		c.singleFlightGroup = group
+	}
+}
+
+func WithTracer(tracer Tracer) Option {
+	return func(c *config) {
+		c.tracer = tracer
+	}
+}
+
+// WithTieredMaxDelay caps the delay after attempt n at maxDelayFn(n) instead
+// of the single SetMaxDelayTimeFn value, e.g. to keep early retries fast and
+// give the service more room later.
+func WithTieredMaxDelay(maxDelayFn func(n uint) time.Duration) Option {
+	return func(c *config) {
+		c.maxDelayFn = maxDelayFn
+	}
+}
+
+// WithErrorAccumulator replaces the built-in error collection, and with it
+// WithLastErrorOnly, WithErrorSummaryOnly and WithErrorSampleRate, by acc.
+// acc isn't reset between Do calls, so pass a new one to each.
+func WithErrorAccumulator(acc ErrorAccumulator) Option {
+	return func(c *config) {
+		c.errorAccumulator = acc
+	}
+}
+
+// WithResultRetryIf makes DoWithData retry when retryIf returns true for the
+// data of an attempt that returned no error, as if it failed with
+// ErrResultRejected. T must be the type of the DoWithData data; Do ignores it.
+func WithResultRetryIf[T any](retryIf func(T) bool) Option {
+	return func(c *config) {
+		c.resultRetryIf = func(data interface{}) bool {
+			v, ok := data.(T)
+			return ok && retryIf(v)
+		}
+	}
+}
+
+// WithRandSource makes the random parts of delays, in RandomDelayFn, the
+// jitter functions and cap smoothing, draw from src instead of the global
+// math/rand source. src is used by a single Do call at a time.
+func WithRandSource(src rand.Source) Option {
+	return func(c *config) {
+		c.rand = rand.New(src)
+	}
+}
+
+// WithClusterSeed makes the random parts of delays reproducible: every Do
+// call draws them from a source seeded with seed XOR spreadByNodeID(). Nodes
+// sharing the seed and node ID retry together, nodes with different IDs
+// spread out. A nil spreadByNodeID means every node retries together.
+func WithClusterSeed(seed int64, spreadByNodeID func() int64) Option {
+	return func(c *config) {
+		if spreadByNodeID != nil {
+			seed ^= spreadByNodeID()
+		}
+		WithRandSource(rand.NewSource(seed))(c)
+	}
+}
+
+// WithSpinForDelaysBelow busy-waits instead of sleeping for delays shorter
+// than threshold, for platforms where timers are too coarse for them. The
+// context is still checked while spinning.
+func WithSpinForDelaysBelow(threshold time.Duration) Option {
+	return func(c *config) {
+		c.spinThreshold = threshold
+	}
+}
+
+// WithCollectResults stores into out the data returned by every attempt of
+// DoWithData, failed ones included, keeping only the last limit values. T
+// must be the type of the DoWithData data; Do ignores it. The values are
+// collected per call and copied into out when DoWithData returns, so calls
+// sharing the option leave out with the values of the last one to finish. A
+// call that got no value of type T, like a single-flight follower, leaves out
+// as is.
+func WithCollectResults[T any](out *[]T, limit int) Option {
+	var outMu sync.Mutex
+	return func(c *config) {
+		var mu sync.Mutex
+		var results []T
+		var collected bool
+		c.collectResult = func(data interface{}) {
+			v, ok := data.(T)
+			if !ok {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			collected = true
+			if len(results) >= limit {
+				if limit <= 0 {
+					return
+				}
+				results = append(results[:0], results[len(results)-limit+1:]...)
+			}
+			results = append(results, v)
+		}
+		c.flushResults = func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if !collected {
+				return
+			}
+			outMu.Lock()
+			defer outMu.Unlock()
+			*out = append((*out)[:0], results...)
+		}
+	}
+}
+
+// WithLeaseDeadline bounds retries by the expiry of a lease, e.g. of a
+// distributed lock, that leaseDeadline returns. Delays are cut to end at the
+// expiry and no attempt starts after it.
+func WithLeaseDeadline(leaseDeadline func() time.Time) Option {
+	return func(c *config) {
+		c.leaseDeadline = leaseDeadline
+	}
+}
+
+// WithErrorTagger records the error of every failed attempt as a TaggedError
+// with the tags tagger returns for it, e.g. the region or endpoint used. The
+// tags can be found in the returned error with errors.As.
+func WithErrorTagger(tagger func(attempt uint, err error) map[string]string) Option {
+	return func(c *config) {
+		c.errorTagger = tagger
+	}
+}
+
+// WithFillDeadline retries with the delays of df until the context is done,
+// whatever the number of attempts, e.g. to retry until the context deadline.
+// Without a deadline or cancellation it retries until f succeeds.
+func WithFillDeadline(df DelayFn) Option {
+	return func(c *config) {
+		WithDelayFn(df)(c)
+		c.fillDeadline = true
+	}
+}
+
+// WithSaturationGuard stops retrying once the last failureWindow attempts all
+// failed after taking longer than latencyThreshold, as retrying a saturated
+// dependency only makes things worse.
+func WithSaturationGuard(latencyThreshold time.Duration, failureWindow uint) Option {
+	return func(c *config) {
+		c.saturationLatency = latencyThreshold
+		c.saturationWindow = failureWindow
+	}
+}
+
+// WithLoopGuard checks guard before every attempt, with whether the previous
+// one succeeded, and stops the loop when it returns false. With a guard the
+// loop doesn't stop on success, only on the guard or the last attempt, e.g.
+// to retry until a value is stable and some external flag is set. A guard
+// stopping the loop before the first attempt makes Do return
+// ErrLoopGuardStopped.
+func WithLoopGuard(guard func(attempt uint, lastResultWasSuccess bool) bool) Option {
+	return func(c *config) {
+		c.loopGuard = guard
+	}
+}
+
+// WithMaxElapsedTime gives up, returning the errors so far, instead of
+// waiting for an attempt that would start more than d after Do began. It
+// works alongside WithAttempts and the context: the first limit hit stops Do.
+func WithMaxElapsedTime(d time.Duration) Option {
+	return func(c *config) {
+		c.maxElapsedTime = d
+	}
+}
+
+// WithJitter adds the time returned by jitter to every delay, keeping the
+// total within the max delay time.
+func WithJitter(jitter JitterFn) Option {
+	return func(c *config) {
+		c.jitterFn = jitter
+	}
+}
+
+// WithMaxTotalSleep caps the time one Do call spends sleeping between
+// attempts at d. A delay that doesn't fit in what is left of d is shrunk to
+// fit, so once d is spent the remaining attempts run without delay.
+func WithMaxTotalSleep(d time.Duration) Option {
+	return func(c *config) {
+		c.maxTotalSleep = d
+	}
+}
+
+// WithOnSleepFn calls onSleep with the delay Do is about to sleep after
+// attempt, once every option changing it has been applied.
+func WithOnSleepFn(onSleep func(attempt uint, sleep time.Duration)) Option {
+	return func(c *config) {
+		c.onSleepFn = onSleep
+	}
+}
+
+// WithEndpointHealth reports every failed attempt to registry under the
+// endpoint endpointKey finds in the error, and stops retrying as soon as
+// registry considers that endpoint down.
+func WithEndpointHealth(registry HealthRegistry, endpointKey func(error) string) Option {
+	return func(c *config) {
+		c.healthRegistry = registry
+		c.endpointKey = endpointKey
+	}
+}
+
+// WithRetryOnErrors retries only errors matching one of targets with
+// errors.Is. It is checked on top of the RetryIfFn, both must allow a retry.
+func WithRetryOnErrors(targets ...error) Option {
+	return func(c *config) {
+		c.retryOnErrors = append(c.retryOnErrors, targets...)
+	}
+}
+
+// WithAbortOnErrors stops retrying on errors matching one of targets with
+// errors.Is, whatever the RetryIfFn says.
+func WithAbortOnErrors(targets ...error) Option {
+	return func(c *config) {
+		c.abortOnErrors = append(c.abortOnErrors, targets...)
+	}
+}
+
+// WithMatcher retries and stops on errors like WithRetryOnErrors and
+// WithAbortOnErrors with the target lists compiled in m, which is faster with
+// long lists.
+func WithMatcher(m *Matcher) Option {
+	return func(c *config) {
+		c.matcher = m
+	}
+}
+
+// WithShutdownContext stops Do from starting new attempts once ctx is done,
+// for graceful shutdown, without interrupting the attempt in flight the way
+// the context of WithContext does. Do then returns the errors so far.
+func WithShutdownContext(ctx context.Context) Option {
+	return func(c *config) {
+		c.shutdownCtx = ctx
+	}
+}
+
+// WithOnSuccessFn calls onSuccess with the number of attempts made when Do
+// succeeds, 1 when the first attempt did. It isn't called when Do fails.
+func WithOnSuccessFn(onSuccess func(attempts uint)) Option {
+	return func(c *config) {
+		c.onSuccessFn = onSuccess
+	}
+}
+
+// WithDelayRounding rounds every delay down to a multiple of granularity, so
+// that fewer distinct timers are created across a fleet of clients.
+func WithDelayRounding(granularity time.Duration) Option {
+	return func(c *config) {
+		c.delayGranularity = granularity
+	}
+}
+
+// WithStopWhenDelayExceeds gives up, returning the errors so far, instead of
+// waiting a delay longer than d.
+func WithStopWhenDelayExceeds(d time.Duration) Option {
+	return func(c *config) {
+		c.stopDelayThreshold = d
+	}
+}
+
+// WithChronologicalErrors records the error of every failed attempt as an
+// EnrichedError with the time f returned it, like WithEnrichErrors without
+// looking up the goroutine, so ChronologicalErrors can merge the errors of
+// concurrent Do calls, e.g. the items of DoAll, in the order they occurred.
+func WithChronologicalErrors(chronological bool) Option {
+	return func(c *config) {
+		c.chronologicalErrors = chronological
+	}
+}
+
+// WithRefreshContext derives the context passed to f by DoWithContext anew
+// before every attempt, e.g. to carry a renewed auth token. An error from
+// refresh stops Do and is recorded as the error of that attempt.
+func WithRefreshContext(refresh func(parent context.Context, attempt uint) (context.Context, error)) Option {
+	return func(c *config) {
+		c.refreshContext = refresh
+	}
+}
+
+// WithDelay waits d between attempts, the same as
+// WithDelayFn(FixDelayFn, SetFixTimeFn(d)).
+func WithDelay(d time.Duration) Option {
+	return WithDelayFn(FixDelayFn, SetFixTimeFn(d))
+}
+
+// WithMaxDelay caps every delay at d, like SetMaxDelayTimeFn, whatever the
+// order it comes in with WithDelay or WithDelayFn.
+func WithMaxDelay(d time.Duration) Option {
+	return func(c *config) {
+		c.maxDelayTime = d
+	}
+}
+
+// WithMinAttemptInterval starts attempts at least d apart, even when the
+// delay is shorter or skipped, so an f failing instantly can't spin the CPU.
+func WithMinAttemptInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.minAttemptInterval = d
+	}
+}
+
+// WithEnrichErrors records the error of every failed attempt as an
+// EnrichedError, with the time and the goroutine f returned it in, to help
+// diagnose concurrency issues. It can be found with errors.As.
+func WithEnrichErrors(enrich bool) Option {
+	return func(c *config) {
+		c.enrichErrors = enrich
+	}
+}
+
+// WithClock makes Do wait and tell time with clock instead of the real time,
+// so tests can run delays without sleeping.
+func WithClock(clock Clock) Option {
+	return func(c *config) {
+		c.clock = clock
+	}
+}
+
+// WithReporter sends the attempts, delays and outcome of Do to reporter.
+func WithReporter(reporter Reporter) Option {
+	return func(c *config) {
+		c.reporter = reporter
+	}
+}
+
+// WithBulkhead isolates the retries of failing dependencies from each other:
+// an attempt retrying an error of a category in limits waits for a slot in the
+// pool of that category, which allows at most limits[category] attempts at the
+// same time. The pools are shared by all the Do calls given the returned
+// Option. First attempts and categories not in limits aren't limited.
+func WithBulkhead(category func(error) string, limits map[string]uint) Option {
+	b := newBulkhead(category, limits)
+	return func(c *config) {
+		c.bulkhead = b
+	}
+}
+
+// WithErrorSelector makes Do return the error picked by selector among the
+// errors of the attempts instead of all of them, e.g. the most severe one.
+// WithLastErrorOnly takes precedence.
+func WithErrorSelector(selector func(errs []error) error) Option {
+	return func(c *config) {
+		c.errorSelector = selector
+	}
+}
+
+// WithRequireCancellableContext makes Do fail with ErrContextNotCancellable
+// instead of retrying forever when WithAttempts(0) is used with a context that
+// can never be cancelled, such as context.Background().
+func WithRequireCancellableContext(require bool) Option {
+	return func(c *config) {
+		c.requireCancellableCtx = require
+	}
+}
+
+// WithState keeps state up to date with the attempts made and the next delay
+// before every delay, so the retries can be resumed with ResumeDo after a
+// restart.
+func WithState(state *State) Option {
+	return func(c *config) {
+		c.state = state
+	}
+}
+
 func WithLastErrorOnly(lastErrorOnly bool) Option {
 	return func(c *config) {
 		c.lastErrorOnly = lastErrorOnly
@@ -0,0 +1,89 @@
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+// Reporter receives the events of Do calls, to feed metrics such as
+// Prometheus or OpenTelemetry ones. Attempt numbers follow
+// WithOneBasedAttempts like everywhere else.
+type Reporter interface {
+	// OnAttempt is called after every attempt with its error, nil on success.
+	OnAttempt(n uint, err error)
+	// OnDelay is called before sleeping d after attempt n.
+	OnDelay(n uint, d time.Duration)
+	// OnFinish is called once Do is done, with the number of attempts made
+	// and the error returned.
+	OnFinish(total uint, err error)
+}
+
+// NamedReporter is a Reporter that tells the Do calls apart by their
+// WithName name. Do calls Named once and reports to the returned Reporter.
+type NamedReporter interface {
+	Reporter
+	Named(name string) Reporter
+}
+
+func (c *config) namedReporter() Reporter {
+	if named, ok := c.reporter.(NamedReporter); ok && c.name != "" {
+		return named.Named(c.name)
+	}
+	return c.reporter
+}
+
+type noopReporter struct{}
+
+func (noopReporter) OnAttempt(uint, error)          {}
+func (noopReporter) OnDelay(uint, time.Duration)    {}
+func (noopReporter) OnFinish(total uint, err error) {}
+
+// CountingReporter is a Reporter that adds up the events it gets, mostly for
+// tests. It can be shared by concurrent Do calls; read it with Counts.
+type CountingReporter struct {
+	mu     sync.Mutex
+	counts ReporterCounts
+}
+
+// ReporterCounts are the totals of a CountingReporter.
+type ReporterCounts struct {
+	Attempts   uint
+	Failures   uint
+	Delays     uint
+	TotalDelay time.Duration
+	Finished   uint
+	// FinishedWithError counts the Do calls that returned an error.
+	FinishedWithError uint
+}
+
+func (r *CountingReporter) OnAttempt(n uint, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts.Attempts++
+	if err != nil {
+		r.counts.Failures++
+	}
+}
+
+func (r *CountingReporter) OnDelay(n uint, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts.Delays++
+	r.counts.TotalDelay += d
+}
+
+func (r *CountingReporter) OnFinish(total uint, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts.Finished++
+	if err != nil {
+		r.counts.FinishedWithError++
+	}
+}
+
+// Counts returns the totals so far.
+func (r *CountingReporter) Counts() ReporterCounts {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts
+}
@@ -0,0 +1,54 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountingReporter(t *testing.T) {
+	reporter := &CountingReporter{}
+	var calls int
+	err := Do(func() error {
+		calls++
+		if calls <= 3 {
+			return errors.New("error")
+		}
+		return nil
+	}, WithReporter(reporter), WithDelayFn(FixDelayFn, SetFixTimeFn(time.Millisecond)))
+	assert.NoError(t, err)
+
+	assert.Equal(t, ReporterCounts{
+		Attempts:   4,
+		Failures:   3,
+		Delays:     3,
+		TotalDelay: 3 * time.Millisecond,
+		Finished:   1,
+	}, reporter.Counts())
+}
+
+type namedReporter struct {
+	noopReporter
+	name     string
+	attempts map[string]uint
+}
+
+func (r *namedReporter) Named(name string) Reporter {
+	return &namedReporter{name: name, attempts: r.attempts}
+}
+
+func (r *namedReporter) OnAttempt(n uint, err error) {
+	r.attempts[r.name]++
+}
+
+func TestNamedReporter(t *testing.T) {
+	reporter := &namedReporter{attempts: map[string]uint{}}
+	err := Do(func() error {
+		return errors.New("error")
+	}, WithReporter(reporter), WithName("fetchUser"), WithAttempts(2), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	assert.Equal(t, "Retry Error [fetchUser]: \n# 0: error\n# 1: error", err.Error())
+	assert.Equal(t, map[string]uint{"fetchUser": 2}, reporter.attempts)
+}
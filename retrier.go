@@ -0,0 +1,133 @@
+package retry
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Retrier runs Do calls with a shared set of options and keeps statistics
+// across them. It is safe for concurrent use.
+type Retrier struct {
+	opts []Option
+
+	mu    sync.Mutex
+	stats RetrierStats
+	// failures counts the consecutive failed attempts across calls, for
+	// AdditiveResetDelayFn.
+	failures uint
+}
+
+// RetrierStats are the cumulative statistics of the Do calls of a Retrier.
+type RetrierStats struct {
+	Calls     uint64
+	Successes uint64
+	// Retries counts the attempts after the first one of every call.
+	Retries uint64
+	// DelayHistogram counts the delays slept between attempts by the upper
+	// bound of their bucket, the last bucket being unbounded.
+	DelayHistogram []DelayBucket
+}
+
+type DelayBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// SuccessRate is the fraction of calls that succeeded, 0 without calls.
+func (s RetrierStats) SuccessRate() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+	return float64(s.Successes) / float64(s.Calls)
+}
+
+var delayBucketBounds = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+	time.Duration(math.MaxInt64),
+}
+
+// New returns a Retrier applying opts to every Do call.
+func New(opts ...Option) *Retrier {
+	r := &Retrier{opts: opts}
+	for _, bound := range delayBucketBounds {
+		r.stats.DelayHistogram = append(r.stats.DelayHistogram, DelayBucket{UpperBound: bound})
+	}
+	return r
+}
+
+// Do is like the package level Do with the options of the Retrier, followed
+// by opts. Every call gets its own config, so the state of the delay
+// functions, like the last sleep of DecorrelatedJitterDelayFn, isn't shared
+// between calls.
+func (r *Retrier) Do(f func() error, opts ...Option) error {
+	_, err := RetrierDoWithData(r, func() (struct{}, error) {
+		return struct{}{}, f()
+	}, opts...)
+	return err
+}
+
+// RetrierDoWithData is like DoWithData with the options of r, followed by
+// opts, counting in the statistics of r. Go methods can't have type
+// parameters, hence a function.
+func RetrierDoWithData[T any](r *Retrier, f func() (T, error), opts ...Option) (T, error) {
+	cfg := newConfig(append(r.opts[:len(r.opts):len(r.opts)], opts...)...)
+	result := cfg.result
+	if result == nil {
+		result = &DoResult{}
+		cfg.result = result
+	}
+
+	data, err := doWithData(f, cfg)
+	r.record(err, result.Delays)
+	return data, err
+}
+
+func (r *Retrier) record(err error, delays []time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Calls++
+	if err == nil {
+		r.stats.Successes++
+		r.failures = 0
+	} else {
+		// the last failed attempt of a call has no delay
+		r.failures++
+	}
+	r.stats.Retries += uint64(len(delays))
+	for _, delay := range delays {
+		for i := range r.stats.DelayHistogram {
+			if delay <= r.stats.DelayHistogram[i].UpperBound {
+				r.stats.DelayHistogram[i].Count++
+				break
+			}
+		}
+	}
+}
+
+// Stats returns a snapshot of the statistics of the Do calls so far.
+func (r *Retrier) Stats() RetrierStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.DelayHistogram = append([]DelayBucket(nil), r.stats.DelayHistogram...)
+	return stats
+}
+
+// AdditiveResetDelayFn returns a DelayFn for the Do calls of r that waits
+// increment more for every consecutive failed attempt, across calls, and goes
+// back to increment after a call succeeds. It suits a steady reconciliation
+// loop backing off while a dependency is down and recovering at once. The
+// failures are counted by r, so the DelayFn can be made for every call.
+func (r *Retrier) AdditiveResetDelayFn(increment time.Duration) DelayFn {
+	return func(n uint, err error, c *config) time.Duration {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.failures++
+		return time.Duration(r.failures) * increment
+	}
+}
@@ -0,0 +1,141 @@
+package retry
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrier(t *testing.T) {
+	r := New(WithAttempts(3), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	var calls int
+	err := r.Do(func() error {
+		calls++
+		return errors.New("error")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = r.Do(func() error {
+		calls++
+		return errors.New("error")
+	}, WithAttempts(5))
+	assert.Error(t, err)
+	assert.Equal(t, 5, calls, "per-call options should override the retrier ones")
+}
+
+func TestRetrierStats(t *testing.T) {
+	r := New(WithAttempts(3), WithDelayFn(FixDelayFn, SetFixTimeFn(time.Microsecond)))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		// succeeds on the second attempt
+		go func() {
+			defer wg.Done()
+			var calls int32
+			assert.NoError(t, r.Do(func() error {
+				if atomic.AddInt32(&calls, 1) < 2 {
+					return errors.New("error")
+				}
+				return nil
+			}))
+		}()
+		// fails every attempt
+		go func() {
+			defer wg.Done()
+			assert.Error(t, r.Do(func() error {
+				return errors.New("error")
+			}))
+		}()
+	}
+	wg.Wait()
+
+	stats := r.Stats()
+	assert.Equal(t, uint64(100), stats.Calls)
+	assert.Equal(t, uint64(50), stats.Successes)
+	assert.Equal(t, 0.5, stats.SuccessRate())
+	assert.Equal(t, uint64(50*1+50*2), stats.Retries)
+	assert.Equal(t, uint64(150), stats.DelayHistogram[0].Count, "every delay should be in the first bucket")
+	var total uint64
+	for _, bucket := range stats.DelayHistogram {
+		total += bucket.Count
+	}
+	assert.Equal(t, stats.Retries, total)
+}
+
+func TestRetrierAdditiveResetDelayFn(t *testing.T) {
+	r := New(WithAttempts(3))
+	df := r.AdditiveResetDelayFn(time.Millisecond)
+
+	run := func(succeedAfter int) []time.Duration {
+		var result DoResult
+		var calls int
+		_ = r.Do(func() error {
+			calls++
+			if succeedAfter > 0 && calls > succeedAfter {
+				return nil
+			}
+			return errors.New("error")
+		}, WithDelayFn(df), WithDoResult(&result))
+		return scaleDurations(result.Delays, time.Millisecond)
+	}
+
+	assert.Equal(t, []time.Duration{1, 2}, run(0))
+	assert.Equal(t, []time.Duration{4, 5}, run(0), "failures should keep adding up across calls")
+	assert.Equal(t, []time.Duration{7}, run(1))
+	assert.Equal(t, []time.Duration{1, 2}, run(0), "a success should reset the delay")
+}
+
+func TestRetrierAdditiveResetDelayFnPerCall(t *testing.T) {
+	r := New(WithAttempts(3))
+
+	run := func() []time.Duration {
+		var result DoResult
+		_ = r.Do(func() error {
+			return errors.New("error")
+		}, WithDelayFn(r.AdditiveResetDelayFn(time.Millisecond)), WithDoResult(&result))
+		return scaleDurations(result.Delays, time.Millisecond)
+	}
+
+	assert.Equal(t, []time.Duration{1, 2}, run())
+	assert.Equal(t, []time.Duration{4, 5}, run(), "a new DelayFn should go on from the failures of r")
+}
+
+func TestRetrierDoWithData(t *testing.T) {
+	r := New(WithAttempts(3), WithDelayFn(BackOffDelayFn, SetBackOffBeginTimeFn(time.Millisecond)))
+
+	var calls int
+	v, err := RetrierDoWithData(r, func() (int, error) {
+		calls++
+		if calls < 2 {
+			return 0, errors.New("error")
+		}
+		return 42, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 42, v)
+	assert.Equal(t, uint64(1), r.Stats().Successes)
+}
+
+func TestRetrierIsolatesCalls(t *testing.T) {
+	// doubles the delay kept in the config at every retry
+	growing := func(n uint, err error, c *config) time.Duration {
+		c.delayTime *= 2
+		return c.delayTime
+	}
+	r := New(WithAttempts(3), WithDelayFn(growing, SetFixTimeFn(time.Millisecond)))
+
+	var fetch, store DoResult
+	assert.Error(t, r.Do(func() error { return errors.New("fetch") }, WithDoResult(&fetch)))
+	assert.Error(t, r.Do(func() error { return errors.New("store") }, WithDoResult(&store)))
+
+	assert.Equal(t, []time.Duration{2, 4}, scaleDurations(fetch.Delays, time.Millisecond))
+	assert.Equal(t, []time.Duration{2, 4}, scaleDurations(store.Delays, time.Millisecond), "the second call should not go on from the delay of the first one")
+}
@@ -4,7 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,131 +26,1396 @@ func UnrecoverableError(err error) unrecoverableError {
 	}
 }
 
+func IsUnrecoverableError(err error) bool {
+	_, ok := asError[unrecoverableError](err)
+	return ok
+}
+
+// Deprecated: use IsUnrecoverableError.
 func IsReconverableError(err error) bool {
-	ue := unrecoverableError{}
-	return errors.As(err, &ue)
+	return IsUnrecoverableError(err)
 }
 
 func UnwrapUnrecoverableError(err error) error {
-	if IsReconverableError(err) {
-		ue := err.(unrecoverableError)
+	if ue, ok := asError[unrecoverableError](err); ok {
 		return ue.err
 	}
 	return err
 }
 
-// TODO cyx errors.Is & errors.As
+// asError is errors.As for the marker types of Do, which it checks on every
+// attempt: it walks the tree of err the same way, without the reflection and
+// the allocation of errors.As.
+func asError[T error](err error) (T, bool) {
+	for err != nil {
+		if e, ok := err.(T); ok {
+			return e, true
+		}
+		switch u := err.(type) {
+		case interface{ Unwrap() error }:
+			err = u.Unwrap()
+		case interface{ Unwrap() []error }:
+			for _, err := range u.Unwrap() {
+				if e, ok := asError[T](err); ok {
+					return e, true
+				}
+			}
+			err = nil
+		default:
+			err = nil
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// retryImmediatelyError marks a transient failure worth retrying right away,
+// without waiting for the delay.
+type retryImmediatelyError struct {
+	err error
+}
+
+func (e retryImmediatelyError) Error() string {
+	return e.err.Error()
+}
+
+// RetryImmediately wraps err so that Do retries it without waiting for the
+// delay. The attempt still counts, and err is recorded unwrapped.
+func RetryImmediately(err error) retryImmediatelyError {
+	return retryImmediatelyError{
+		err: err,
+	}
+}
+
+func IsRetryImmediately(err error) bool {
+	_, ok := asError[retryImmediatelyError](err)
+	return ok
+}
+
+func UnwrapRetryImmediately(err error) error {
+	if re, ok := asError[retryImmediatelyError](err); ok {
+		return re.err
+	}
+	return err
+}
+
+// sideEffectError marks a failure after which retrying is unsafe. Unlike
+// unrecoverableError it says nothing about the error itself: the same error
+// may well go away on retry, but f may already have had a side effect that
+// must not be repeated, e.g. a non-idempotent write that was sent.
+type sideEffectError struct {
+	err error
+}
+
+func (e sideEffectError) Error() string {
+	return e.err.Error()
+}
+
+// SideEffectError wraps err to tell Do that f may have started a side effect,
+// so it stops immediately regardless of the RetryIfFn.
+func SideEffectError(err error) sideEffectError {
+	return sideEffectError{
+		err: err,
+	}
+}
+
+func IsSideEffectError(err error) bool {
+	_, ok := asError[sideEffectError](err)
+	return ok
+}
+
+func UnwrapSideEffectError(err error) error {
+	if se, ok := asError[sideEffectError](err); ok {
+		return se.err
+	}
+	return err
+}
+
+// AnyErrorMatches reports whether match returns true for err or any error in
+// its tree, following both Unwrap() error and the Unwrap() []error of
+// errors.Join. Use it in a RetryIfFn to retry a joined error when one of its
+// errors is retryable.
+func AnyErrorMatches(err error, match func(error) bool) bool {
+	if err == nil {
+		return false
+	}
+	if match(err) {
+		return true
+	}
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return AnyErrorMatches(e.Unwrap(), match)
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			if AnyErrorMatches(err, match) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Error aggregates the errors of the failed attempts. Its entries are the
+// errors f returned, except with WithName, WithOneBasedAttempts,
+// WithErrorSummaryOnly, WithErrorSampleRate or ResumeDo, where every entry is
+// an AttemptError carrying its attempt number. The last entry of an Error
+// whose attempts ran out is an AttemptError too, see Exhausted.
+// WrappedErrors strips them.
 type Error []error
 
-func (e Error) Error() string {
-	var res []string
+// AttemptError is an entry of an Error along with the attempt it comes from,
+// for the entries that don't stand for the attempt of their position or that
+// carry the WithName label.
+type AttemptError struct {
+	Err error
+	// Attempt is the 0-based attempt the error comes from.
+	Attempt uint
+	// OneBased numbers the attempt from 1 in the message of the Error.
+	OneBased bool
+	// Name is the WithName label of the Do call.
+	Name string
+	// Exhausted is set on the last entry when every allowed attempt failed.
+	Exhausted bool
+}
+
+func (e AttemptError) Error() string {
+	return e.Err.Error()
+}
+
+func (e AttemptError) Unwrap() error {
+	return e.Err
+}
+
+// WrappedErrors returns the kept errors of the failed attempts, in order.
+func (e Error) WrappedErrors() []error {
+	errs := make([]error, len(e))
 	for i, v := range e {
-		res = append(res, fmt.Sprintf("# %v: %v", i, v.Error()))
+		if ae, ok := v.(AttemptError); ok {
+			v = ae.Err
+		}
+		errs[i] = v
 	}
-	return fmt.Sprintf("Retry Error: \n%v", strings.Join(res, "\n"))
+	return errs
 }
 
-func (e Error) Is(target error) bool {
+// Attempts returns how many failed attempts the error covers, which can be
+// more than the number of kept errors.
+func (e Error) Attempts() uint {
+	attempts := uint(len(e))
 	for _, v := range e {
-		if errors.Is(v, target) {
-			return true
+		if ae, ok := v.(AttemptError); ok && ae.Attempt+1 > attempts {
+			attempts = ae.Attempt + 1
 		}
 	}
-	return false
+	return attempts
 }
 
-func (e Error) As(target interface{}) bool {
-	for _, v := range e {
-		if errors.As(v, target) {
-			return true
+// Exhausted reports whether Do gave up because every allowed attempt failed,
+// rather than stopping early on an unrecoverable error or a RetryIfFn.
+func (e Error) Exhausted() bool {
+	if len(e) == 0 {
+		return false
+	}
+	ae, ok := e[len(e)-1].(AttemptError)
+	return ok && ae.Exhausted
+}
+
+func (e Error) Error() string {
+	return e.format("%v")
+}
+
+// Format prints each error with %+v under the %+v verb, so wrapped chains and
+// stack traces are kept; every other verb prints the compact Error() form.
+func (e Error) Format(s fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		if s.Flag('+') {
+			fmt.Fprint(s, e.format("%+v"))
+			return
 		}
+		fmt.Fprint(s, e.Error())
+	case 's':
+		fmt.Fprint(s, e.Error())
+	case 'q':
+		fmt.Fprintf(s, "%q", e.Error())
+	default:
+		fmt.Fprint(s, e.Error())
 	}
-	return false
+}
+
+func (e Error) format(verb string) string {
+	header := "Retry Error"
+	var res []string
+	for i, v := range e {
+		attempt := uint(i)
+		if ae, ok := v.(AttemptError); ok {
+			attempt = ae.Attempt
+			if ae.OneBased {
+				attempt++
+			}
+			if ae.Name != "" {
+				header = fmt.Sprintf("Retry Error [%v]", ae.Name)
+			}
+			v = ae.Err
+		}
+		res = append(res, fmt.Sprintf("# %v: "+verb, attempt, v))
+	}
+	return fmt.Sprintf("%v: \n%v", header, strings.Join(res, "\n"))
+}
+
+// Unwrap returns the errors of the attempts, so that errors.Is and errors.As
+// look through each of them.
+func (e Error) Unwrap() []error {
+	return e
+}
+
+// EnrichedError is the error of an attempt along with when and in which
+// goroutine f returned it, recorded with WithEnrichErrors. With
+// WithChronologicalErrors alone Goroutine is 0.
+type EnrichedError struct {
+	Err       error
+	When      time.Time
+	Goroutine int
+}
+
+func (e EnrichedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e EnrichedError) Unwrap() error {
+	return e.Err
+}
+
+func enrich(f func(context.Context) error, cfg *config) func(context.Context) error {
+	return func(ctx context.Context) error {
+		err := f(ctx)
+		if err == nil {
+			return nil
+		}
+		enriched := EnrichedError{Err: err, When: cfg.now()}
+		if cfg.enrichErrors {
+			enriched.Goroutine = goroutineID()
+		}
+		return enriched
+	}
+}
+
+// goroutineID parses the ID of the current goroutine from the header of its
+// stack trace, "goroutine 42 [running]:".
+func goroutineID() int {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	fields := strings.Fields(string(buf))
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.Atoi(fields[1])
+	return id
+}
+
+// TaggedError is the error of an attempt along with the tags WithErrorTagger
+// computed for it.
+type TaggedError struct {
+	Err  error
+	Tags map[string]string
+}
+
+func (e TaggedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e TaggedError) Unwrap() error {
+	return e.Err
+}
+
+// RetryAfterError is the error of an attempt along with the delay the server
+// asked to wait before the next one, e.g. in a Retry-After header.
+// RetryAfterDelayFn honors it.
+type RetryAfterError struct {
+	Err      error
+	Duration time.Duration
+}
+
+// RetryAfter wraps err to ask RetryAfterDelayFn to wait d before the next
+// attempt.
+func RetryAfter(err error, d time.Duration) error {
+	return RetryAfterError{Err: err, Duration: d}
+}
+
+func (e RetryAfterError) Error() string {
+	return e.Err.Error()
+}
+
+func (e RetryAfterError) Unwrap() error {
+	return e.Err
 }
 
 type config struct {
-	attempts      uint
-	onRetryFn     OnRetryFn
-	retryIfFn     RetryIfFn
-	delayFn       DelayFn
-	randomTime    time.Duration
-	maxDelayTime  time.Duration
-	maxBackOffN   uint
-	delayTime     time.Duration
-	lastErrorOnly bool
-	ctx           context.Context
+	attempts              uint
+	onRetryFn             OnRetryFn
+	retryIfFn             RetryIfFn
+	retryIfWithDurationFn RetryIfWithDurationFn
+	delayFn               DelayFn
+	baseDelayFn           DelayFn
+	randomTime            time.Duration
+	maxDelayTime          time.Duration
+	maxDelayFn            func(uint) time.Duration
+	maxBackOffN           uint
+	delayTime             time.Duration
+	lastErrorOnly         bool
+	capSmoothing          float64
+	parallelism           uint
+	barrier               Barrier
+	stopOnRepeated        uint
+	clock                 Clock
+	logger                StructuredLogger
+	correlationID         string
+	result                *DoResult
+	rawDelay              time.Duration
+	oneBasedAttempts      bool
+	pauseSignal           func() bool
+	retryDecisionFn       RetryDecisionFn
+	onContextDone         func()
+	errorSummaryOnly      bool
+	injectFailuresUntil   uint
+	injectedErr           error
+	name                  string
+	attemptTimeoutFn      func(uint) time.Duration
+	errorSampleEvery      uint
+	backOffFactorMin      float64
+	backOffFactorMax      float64
+	backOffPrev           time.Duration
+	backOffStep           uint
+	nestedBudget          bool
+	batch                 *batchState
+	batchCut              bool
+	batchAbortFraction    float64
+	batchAbortMinSamples  uint
+	delayMultiplier       float64
+	singleFlightKey       string
+	singleFlightGroup     *Group
+	tracer                Tracer
+	errorAccumulator      ErrorAccumulator
+	resultRetryIf         func(interface{}) bool
+	rand                  *rand.Rand
+	spinThreshold         time.Duration
+	collectResult         func(interface{})
+	flushResults          func()
+	leaseDeadline         func() time.Time
+	errorTagger           func(uint, error) map[string]string
+	fillDeadline          bool
+	saturationLatency     time.Duration
+	saturationWindow      uint
+	loopGuard             func(uint, bool) bool
+	maxElapsedTime        time.Duration
+	jitterFn              JitterFn
+	maxTotalSleep         time.Duration
+	onSleepFn             func(uint, time.Duration)
+	decorrelatedBase      time.Duration
+	lastSleep             time.Duration
+	healthRegistry        HealthRegistry
+	endpointKey           func(error) string
+	fibPrev, fibCur       uint64
+	fibN                  uint
+	retryOnErrors         []error
+	abortOnErrors         []error
+	shutdownCtx           context.Context
+	onSuccessFn           func(uint)
+	delayGranularity      time.Duration
+	stopDelayThreshold    time.Duration
+	refreshContext        func(context.Context, uint) (context.Context, error)
+	minAttemptInterval    time.Duration
+	enrichErrors          bool
+	chronologicalErrors   bool
+	operation             string
+	reporter              Reporter
+	bulkhead              *bulkhead
+	errorSelector         func([]error) error
+	requireCancellableCtx bool
+	state                 *State
+	resume                *State
+	matcher               *Matcher
+	ctx                   context.Context
 }
 
 func Do(f func() error, opts ...Option) error {
+	_, err := DoWithData(func() (struct{}, error) {
+		return struct{}{}, f()
+	}, opts...)
+	return err
+}
 
-	cfg := newDefaultConfig()
+// DoNamed is like Do but labels every attempt with the operation name, in the
+// LogFieldOperation field of logs and tracer spans. Unlike WithName, which
+// names the retry policy, it names what a single call does.
+func DoNamed(name string, f func() error, opts ...Option) error {
+	cfg := newConfig(opts...)
+	cfg.operation = name
+	_, err := doWithData(func() (struct{}, error) {
+		return struct{}{}, f()
+	}, cfg)
+	return err
+}
 
-	for _, opt := range opts {
-		opt(cfg)
+// DoWithContext is like Do but passes ctx into every call of f. The explicit
+// ctx takes precedence over any WithContext option.
+func DoWithContext(ctx context.Context, f func(context.Context) error, opts ...Option) error {
+	cfg := newConfig(opts...)
+	cfg.ctx = ctx
+	_, err := doWithContextData(func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, f(ctx)
+	}, cfg)
+	return err
+}
+
+// ErrLeaseExpired is returned, wrapping the errors of the attempts made, when
+// the lease set by WithLeaseDeadline expires before the next attempt.
+var ErrLeaseExpired = errors.New("retry: lease expired")
+
+// ErrContextNotCancellable is returned by a Do call with WithAttempts(0) and
+// WithRequireCancellableContext whose context can never be cancelled, since
+// it would retry forever.
+var ErrContextNotCancellable = errors.New("retry: context can never be cancelled")
+
+// ErrLoopGuardStopped is returned when the guard of WithLoopGuard stops the
+// loop before the first attempt, so f never ran.
+var ErrLoopGuardStopped = errors.New("retry: loop guard stopped before the first attempt")
+
+// ErrResumeExhausted is returned by ResumeDo, without calling f, when the
+// attempts of the state already use up WithAttempts.
+var ErrResumeExhausted = errors.New("retry: no attempts left to resume")
+
+// ErrResultRejected is the error of a DoWithData attempt whose data was
+// rejected by WithResultRetryIf.
+var ErrResultRejected = errors.New("retry: result rejected")
+
+// DoWithData is like Do for an f that also returns data, without closing over
+// a variable set by every attempt. It returns the data of the successful
+// attempt, or the zero value of T along with the error, which is the context
+// error when the context ends first.
+func DoWithData[T any](f func() (T, error), opts ...Option) (T, error) {
+	return doWithData(f, newConfig(opts...))
+}
+
+// DoWithPartialData is like DoWithData for an f building on the data it
+// returned at the previous attempt, e.g. fetching the pages not fetched yet.
+// f gets the zero value of T at the first attempt. When Do fails, after the
+// context is done for instance, the latest data is returned with the error.
+func DoWithPartialData[T any](f func(prev T) (T, error), opts ...Option) (T, error) {
+	var (
+		mu     sync.Mutex
+		latest T
+	)
+	data, err := DoWithData(func() (T, error) {
+		mu.Lock()
+		prev := latest
+		mu.Unlock()
+		v, err := f(prev)
+		mu.Lock()
+		latest = v
+		mu.Unlock()
+		return v, err
+	}, opts...)
+	if err != nil {
+		mu.Lock()
+		defer mu.Unlock()
+		return latest, err
+	}
+	return data, nil
+}
+
+// DoUntil is like DoWithData but also retries while done returns false for
+// the data of a successful attempt, e.g. to poll until a job is ready. When
+// the attempts run out first, the error wraps ErrResultRejected.
+func DoUntil[T any](f func() (T, error), done func(T) bool, opts ...Option) (T, error) {
+	until := WithResultRetryIf(func(v T) bool {
+		return !done(v)
+	})
+	return DoWithData(f, append(opts[:len(opts):len(opts)], until)...)
+}
+
+const (
+	defaultPollDelay    = 100 * time.Millisecond
+	defaultPollMaxDelay = 10 * time.Second
+)
+
+// DoPollUntil is DoUntil with an exponential backoff, starting at 100ms and
+// capped at 10s, for polling a status until ready returns true. It returns
+// the first ready data, or the zero value of T and the errors of the attempts
+// when they run out. opts come after the backoff and can replace it.
+func DoPollUntil[T any](f func() (T, error), ready func(T) bool, opts ...Option) (T, error) {
+	backOff := WithDelayFn(BackOffDelayFn, SetFixTimeFn(defaultPollDelay), SetMaxDelayTimeFn(defaultPollMaxDelay))
+	return DoUntil(f, ready, append([]Option{backOff}, opts...)...)
+}
+
+func doWithData[T any](f func() (T, error), cfg *config) (T, error) {
+	return doWithContextData(func(context.Context) (T, error) {
+		return f()
+	}, cfg)
+}
+
+// doWithContextData runs the DoWithData loop for an f getting the context of
+// the attempt, which every entry point goes through.
+func doWithContextData[T any](f func(context.Context) (T, error), cfg *config) (T, error) {
+	run := func() (interface{}, error) {
+		var (
+			mu   sync.Mutex
+			data T
+			set  bool
+		)
+		err := do(func(ctx context.Context) error {
+			v, err := f(ctx)
+			if cfg.collectResult != nil {
+				cfg.collectResult(v)
+			}
+			if err == nil && cfg.resultRetryIf != nil && cfg.resultRetryIf(v) {
+				err = ErrResultRejected
+			}
+			if err == nil {
+				mu.Lock()
+				// with WithParallelism only the first successful copy counts,
+				// with WithLoopGuard the latest successful attempt does
+				if !set || cfg.loopGuard != nil {
+					data, set = v, true
+				}
+				mu.Unlock()
+			}
+			return err
+		}, cfg)
+		if err != nil {
+			// a loop guard can see a success before the call fails
+			var zero T
+			data = zero
+		}
+		return data, err
+	}
+
+	var (
+		data interface{}
+		err  error
+	)
+	if cfg.singleFlightGroup == nil {
+		data, err = run()
+	} else {
+		data, err = cfg.singleFlightGroup.do(cfg.ctx, cfg.singleFlightKey, run)
+	}
+	if cfg.flushResults != nil {
+		cfg.flushResults()
+	}
+	// a nil interface T comes back as a nil interface{}
+	v, _ := data.(T)
+	return v, err
+}
+
+func do(f func(context.Context) error, cfg *config) (err error) {
+	begin := cfg.now()
+	var reason StopReason
+	cfg.reporter = cfg.namedReporter()
+	var attempts uint
+	defer func() {
+		cfg.reporter.OnFinish(attempts, err)
+	}()
+	if cfg.result != nil {
+		defer func() {
+			cfg.result.TotalElapsed = cfg.now().Sub(begin)
+			cfg.result.StopReason = reason
+		}()
+	}
+
+	if cfg.barrier != nil {
+		defer cfg.barrier.Leave()
+	}
+
+	if cfg.onContextDone != nil {
+		done := make(chan struct{})
+		stop := context.AfterFunc(cfg.ctx, func() {
+			defer close(done)
+			cfg.onContextDone()
+		})
+		defer func() {
+			// wait for a callback that already started
+			if !stop() {
+				<-done
+			}
+		}()
 	}
 
 	if err := cfg.ctx.Err(); err != nil {
+		reason = ContextCancelled
 		return err
 	}
+	// a nil Done channel is never closed
+	if cfg.requireCancellableCtx && cfg.unbounded() && cfg.ctx.Done() == nil {
+		reason = Aborted
+		return ErrContextNotCancellable
+	}
 
-	if cfg.attempts == 0 {
-		// infinite loop
-		return nil
+	var errs ErrorAccumulator = newErrorLog(cfg)
+	if cfg.errorAccumulator != nil {
+		errs = cfg.errorAccumulator
 	}
+	cfg.correlationID = nextCorrelationID()
 
-	var errs Error
-	if cfg.lastErrorOnly {
-		errs = make(Error, 1)
-	} else {
-		errs = make(Error, cfg.attempts)
+	budget := nestedBudgetFromContext(cfg.ctx)
+	if cfg.nestedBudget {
+		attemptsLeft := cfg.attempts
+		if cfg.unbounded() {
+			attemptsLeft = ^uint(0)
+		}
+		budget = &nestedBudget{
+			parent:       budget,
+			attemptsLeft: attemptsLeft,
+			sleepLeft:    cfg.maxTotalSleep,
+			limitSleep:   cfg.maxTotalSleep > 0,
+		}
+		cfg.ctx = context.WithValue(cfg.ctx, nestedBudgetKey{}, budget)
+	}
+
+	var n uint
+	if cfg.resume != nil {
+		n = cfg.resume.Attempts
+		if !cfg.unbounded() && n >= cfg.attempts {
+			reason = AttemptsExhausted
+			return ErrResumeExhausted
+		}
+		if err := cfg.sleep(cfg.resume.NextDelay); err != nil {
+			reason = ContextCancelled
+			return err
+		}
 	}
-	var n, lastErrIndex uint
-	for ; n < cfg.attempts; n++ {
-		err := f()
+	first := n
+	var repeated repeatedErrors
+	var slowFailures uint
+	var succeeded bool
+	var slept time.Duration
+	var lastStart time.Time
+	var lastErr error
+	for ; cfg.unbounded() || n < cfg.attempts; n++ {
+		if cfg.shutdownCtx != nil && cfg.shutdownCtx.Err() != nil {
+			reason = ContextCancelled
+			if n == first {
+				return cfg.shutdownCtx.Err()
+			}
+			break
+		}
+
+		if cfg.loopGuard != nil && !cfg.loopGuard(cfg.attemptNumber(n), succeeded) {
+			if succeeded {
+				cfg.onSuccess(n)
+				return nil
+			}
+			reason = Aborted
+			if n == first {
+				return ErrLoopGuardStopped
+			}
+			break
+		}
+
+		if budget != nil && !budget.chargeAttempt() {
+			reason = Aborted
+			if n == first {
+				return ErrNestedBudgetExhausted
+			}
+			break
+		}
+
+		if cfg.leaseDeadline != nil && !cfg.now().Before(cfg.leaseDeadline()) {
+			reason = Aborted
+			if n == first {
+				return ErrLeaseExpired
+			}
+			return fmt.Errorf("%w: %w", ErrLeaseExpired, errs.Result())
+		}
+
+		if cfg.barrier != nil {
+			if err := cfg.barrier.Wait(cfg.ctx); err != nil {
+				reason = ContextCancelled
+				if n == first {
+					return err
+				}
+				errs.Record(n-1, err)
+				return errs.Result()
+			}
+		}
+
+		if cfg.minAttemptInterval > 0 && n > first {
+			if wait := cfg.minAttemptInterval - cfg.now().Sub(lastStart); wait > 0 {
+				if err := cfg.sleep(wait); err != nil {
+					reason = ContextCancelled
+					errs.Record(n-1, err)
+					return errs.Result()
+				}
+			}
+		}
+
+		ctx := cfg.ctx
+		if cfg.refreshContext != nil {
+			var err error
+			if ctx, err = cfg.refreshContext(cfg.ctx, cfg.attemptNumber(n)); err != nil {
+				reason = Aborted
+				if n == first {
+					return err
+				}
+				errs.Record(n, err)
+				break
+			}
+		}
+
+		releaseBulkhead := func() {}
+		if cfg.bulkhead != nil {
+			var err error
+			if releaseBulkhead, err = cfg.bulkhead.acquire(ctx, lastErr); err != nil {
+				reason = ContextCancelled
+				errs.Record(n-1, err)
+				return errs.Result()
+			}
+		}
+
+		slotCtx, releaseSlot, err := acquireGlobalSemaphore(ctx)
+		if err != nil {
+			releaseBulkhead()
+			reason = ContextCancelled
+			if n == first {
+				return err
+			}
+			errs.Record(n-1, err)
+			return errs.Result()
+		}
+		ctx = slotCtx
+
+		ctx, span := cfg.startSpan(ctx, n)
+		start := cfg.now()
+		lastStart = start
+		err = runAttempt(ctx, f, n, cfg)
+		releaseSlot()
+		releaseBulkhead()
+		attemptDuration := cfg.now().Sub(start)
+		// the enrichment is put back around the error once it is recorded
+		enriched, isEnriched := err.(EnrichedError)
+		if isEnriched {
+			err = enriched.Err
+		}
+		if n < cfg.injectFailuresUntil {
+			err = cfg.injectedErr
+		}
+		span.End(err)
+		attempts++
+		cfg.reporter.OnAttempt(cfg.attemptNumber(n), err)
 
 		if err == nil {
-			return nil
+			reason = Succeeded
+			if cfg.result != nil {
+				cfg.result.SuccessAttemptDuration = attemptDuration
+			}
+			cfg.log(cfg.attemptNumber(n), "attempt succeeded", nil)
+			if cfg.loopGuard == nil || cfg.isLastAttempt(n) {
+				cfg.onSuccess(n + 1)
+				return nil
+			}
+			// the loop guard decides whether to go on after a success
+			succeeded = true
+			delay, rawDelay := cfg.nextDelay(n, nil)
+			if cfg.result != nil {
+				cfg.result.RawDelays = append(cfg.result.RawDelays, rawDelay)
+				cfg.result.Delays = append(cfg.result.Delays, delay)
+			}
+			if cfg.onSleepFn != nil {
+				cfg.onSleepFn(cfg.attemptNumber(n), delay)
+			}
+			cfg.reporter.OnDelay(cfg.attemptNumber(n), delay)
+			if err := cfg.sleep(delay); err != nil {
+				reason = ContextCancelled
+				return err
+			}
+			continue
 		}
+		succeeded = false
+		attempt := cfg.attemptNumber(n)
+		cfg.log(attempt, "attempt failed", err)
 
-		if !cfg.lastErrorOnly {
-			lastErrIndex = n
+		unwrapped := UnwrapRetryImmediately(UnwrapSideEffectError(UnwrapUnrecoverableError(err)))
+		lastErr = unwrapped
+		recorded := unwrapped
+		if isEnriched {
+			enriched.Err = recorded
+			recorded = enriched
+		}
+		if cfg.errorTagger != nil {
+			recorded = TaggedError{Err: recorded, Tags: cfg.errorTagger(attempt, unwrapped)}
+		}
+		errs.Record(n, recorded)
+		endpoint := cfg.reportFailure(unwrapped)
+		reason = Aborted
+		if IsSideEffectError(err) {
+			break
+		}
+		decision := cfg.decide(attempt, err)
+		if decision == Stop || !cfg.retryIfWithDurationFn(attempt, err, attemptDuration) {
+			break
+		}
+		if cfg.stopOnRepeated > 0 && repeated.record(unwrapped) >= cfg.stopOnRepeated {
+			break
 		}
-		errs[lastErrIndex] = UnwrapUnrecoverableError(err)
-		if !cfg.retryIfFn(n, err) {
+		if cfg.healthRegistry != nil && cfg.healthRegistry.IsDown(endpoint) {
 			break
 		}
+		if cfg.saturationWindow > 0 {
+			if attemptDuration > cfg.saturationLatency {
+				slowFailures++
+			} else {
+				slowFailures = 0
+			}
+			if slowFailures >= cfg.saturationWindow {
+				break
+			}
+		}
 
-		cfg.onRetryFn(n, err)
+		cfg.onRetryFn(attempt, err)
+		if IsRetryImmediately(err) {
+			decision = RetryNow
+		}
 
-		if n == cfg.attempts-1 {
+		if cfg.isLastAttempt(n) || budget != nil && budget.exhausted() {
+			reason = AttemptsExhausted
+			break
+		}
+		if cfg.batch != nil && cfg.batch.isAborted() {
+			cfg.batchCut = true
 			break
 		}
 
-		select {
-		case <-time.After(cfg.delayFn(n, err, cfg)):
+		if cfg.pauseSignal != nil {
+			if err := cfg.waitWhilePaused(); err != nil {
+				reason = ContextCancelled
+				errs.Record(n, err)
+				return errs.Result()
+			}
+		}
+
+		var delay, rawDelay time.Duration
+		if decision != RetryNow {
+			delay, rawDelay = cfg.nextDelay(n, err)
+		}
+		if cfg.maxTotalSleep > 0 {
+			if remaining := cfg.maxTotalSleep - slept; delay > remaining {
+				delay = remaining
+			}
+			slept += delay
+		}
+		if budget != nil {
+			delay = budget.chargeDelay(delay)
+		}
+		if cfg.stopDelayThreshold > 0 && delay > cfg.stopDelayThreshold {
+			reason = Aborted
 			break
-		case <-cfg.ctx.Done():
-			errs[lastErrIndex] = UnwrapUnrecoverableError(cfg.ctx.Err())
-			if cfg.lastErrorOnly {
-				return errs[lastErrIndex]
+		}
+		if cfg.maxElapsedTime > 0 && cfg.now().Sub(begin)+delay >= cfg.maxElapsedTime {
+			// the next attempt would start past the budget
+			reason = MaxElapsed
+			break
+		}
+		if cfg.result != nil {
+			cfg.result.RawDelays = append(cfg.result.RawDelays, rawDelay)
+			cfg.result.Delays = append(cfg.result.Delays, delay)
+		}
+
+		if cfg.onSleepFn != nil {
+			cfg.onSleepFn(attempt, delay)
+		}
+		cfg.reporter.OnDelay(attempt, delay)
+		if cfg.state != nil {
+			*cfg.state = State{Attempts: n + 1, NextDelay: delay}
+		}
+		if err := cfg.sleep(delay); err != nil {
+			reason = ContextCancelled
+			errs.Record(n, err)
+			return errs.Result()
+		}
+	}
+
+	if l, ok := errs.(*errorLog); ok {
+		l.exhausted = reason == AttemptsExhausted
+	}
+	return errs.Result()
+}
+
+// DoResult reports details about how a Do call went. Pass one to
+// WithDoResult to have it filled in when Do returns.
+type DoResult struct {
+	// SuccessAttemptDuration is how long the successful attempt took, zero if
+	// no attempt succeeded.
+	SuccessAttemptDuration time.Duration
+	// TotalElapsed is the wall-clock time spent in Do, delays included.
+	TotalElapsed time.Duration
+	// Delays holds every delay slept between attempts, after clamping to the
+	// max delay time.
+	Delays []time.Duration
+	// RawDelays holds what the DelayFn returned for each entry in Delays,
+	// before clamping.
+	RawDelays []time.Duration
+	// StopReason tells why Do stopped.
+	StopReason StopReason
+}
+
+type StopReason int
+
+const (
+	// Succeeded means an attempt succeeded.
+	Succeeded StopReason = iota + 1
+	// AttemptsExhausted means every allowed attempt failed.
+	AttemptsExhausted
+	// ContextCancelled means the context was done before Do could finish.
+	ContextCancelled
+	// Aborted means an attempt failed and Do was told not to retry it.
+	Aborted
+	// MaxElapsed means the next attempt would have started after the time
+	// set by WithMaxElapsedTime.
+	MaxElapsed
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case Succeeded:
+		return "Succeeded"
+	case AttemptsExhausted:
+		return "AttemptsExhausted"
+	case ContextCancelled:
+		return "ContextCancelled"
+	case Aborted:
+		return "Aborted"
+	case MaxElapsed:
+		return "MaxElapsed"
+	}
+	return fmt.Sprintf("StopReason(%d)", int(r))
+}
+
+// ErrorAccumulator collects the errors of the failed attempts of a Do call and
+// builds the error Do returns from them. When the context ends while waiting
+// for the next attempt, Record is called again for the last attempt with the
+// context error, which should replace the earlier one.
+type ErrorAccumulator interface {
+	Record(n uint, err error)
+	Result() error
+}
+
+// errorLog is the built-in ErrorAccumulator. It keeps the errors of failed
+// attempts: all of them, only the last one, or a sample always including the
+// first and the last one, as configured.
+type errorLog struct {
+	errs          []error
+	indexes       []uint
+	count         uint
+	lastErrorOnly bool
+	summaryOnly   bool
+	sampleEvery   uint
+	oneBased      bool
+	name          string
+	// first is the attempt the errors start at, past 0 when resuming
+	first uint
+	// exhausted marks the last error as the one of the last allowed attempt
+	exhausted bool
+
+	lastIndex uint
+
+	selector func([]error) error
+
+	// tail holds the latest error while it isn't part of the sample
+	tail      error
+	tailIndex uint
+	hasTail   bool
+}
+
+func newErrorLog(cfg *config) *errorLog {
+	l := &errorLog{
+		lastErrorOnly: cfg.lastErrorOnly,
+		summaryOnly:   cfg.errorSummaryOnly,
+		sampleEvery:   cfg.errorSampleEvery,
+		oneBased:      cfg.oneBasedAttempts,
+		name:          cfg.name,
+		selector:      cfg.errorSelector,
+	}
+	if cfg.resume != nil {
+		l.first = cfg.resume.Attempts
+	}
+	switch {
+	case l.lastErrorOnly:
+		l.errs = make([]error, 1)
+	case l.summaryOnly:
+		l.errs = make([]error, 0, 2)
+		l.indexes = make([]uint, 0, 2)
+	case l.sampleEvery > 0, cfg.unbounded():
+		// the errors grow as they come in
+	default:
+		l.errs = make([]error, 0, cfg.attempts)
+	}
+	if cfg.loopGuard != nil && l.indexes == nil && !l.lastErrorOnly {
+		// successful attempts aren't recorded, so the positions don't give
+		// the attempts
+		l.indexes = []uint{}
+	}
+	return l
+}
+
+func (l *errorLog) Record(n uint, err error) {
+	if l.count > 0 && n == l.lastIndex {
+		l.replaceLast(err)
+		return
+	}
+	l.count++
+	l.lastIndex = n
+	switch {
+	case l.lastErrorOnly:
+		l.errs[0] = err
+	case l.summaryOnly && l.count > 1,
+		l.sampleEvery > 0 && l.count > 1 && n%l.sampleEvery != 0:
+		l.tail, l.tailIndex, l.hasTail = err, n, true
+	case l.summaryOnly, l.sampleEvery > 0:
+		l.errs = append(l.errs, err)
+		l.indexes = append(l.indexes, n)
+		l.hasTail = false
+	default:
+		l.errs = append(l.errs, err)
+		if l.indexes != nil {
+			l.indexes = append(l.indexes, n)
+		}
+	}
+}
+
+func (l *errorLog) last() error {
+	if l.hasTail {
+		return l.tail
+	}
+	return l.errs[len(l.errs)-1]
+}
+
+func (l *errorLog) replaceLast(err error) {
+	if l.hasTail {
+		l.tail = err
+		return
+	}
+	l.errs[len(l.errs)-1] = err
+}
+
+func (l *errorLog) Result() error {
+	if l.lastErrorOnly {
+		return l.last()
+	}
+	if l.hasTail {
+		l.errs = append(l.errs, l.tail)
+		l.indexes = append(l.indexes, l.tailIndex)
+		l.hasTail = false
+	}
+	if l.selector != nil {
+		return l.selector(l.errs)
+	}
+	e := Error(l.errs)
+	if l.indexes != nil || l.oneBased || l.name != "" || l.first > 0 {
+		e = make(Error, len(l.errs))
+		for i, err := range l.errs {
+			attempt := l.first + uint(i)
+			if l.indexes != nil {
+				attempt = l.indexes[i]
 			}
-			return errs
+			e[i] = AttemptError{Err: err, Attempt: attempt, OneBased: l.oneBased, Name: l.name}
+		}
+	}
+	if l.exhausted && len(e) > 0 {
+		last, ok := e[len(e)-1].(AttemptError)
+		if !ok {
+			last = AttemptError{Err: e[len(e)-1], Attempt: uint(len(e) - 1)}
+		}
+		last.Exhausted = true
+		e[len(e)-1] = last
+	}
+	return e
+}
+
+// repeatedErrors counts how often each distinct error has been seen. Errors
+// are told apart by their innermost cause, so differently wrapped occurrences
+// of the same sentinel count as the same error under errors.Is.
+type repeatedErrors struct {
+	causes []error
+	counts []uint
+}
+
+func (r *repeatedErrors) record(err error) uint {
+	for i, v := range r.causes {
+		if errors.Is(err, v) {
+			r.counts[i]++
+			return r.counts[i]
 		}
 	}
+	cause := err
+	for next := errors.Unwrap(cause); next != nil; next = errors.Unwrap(cause) {
+		cause = next
+	}
+	r.causes = append(r.causes, cause)
+	r.counts = append(r.counts, 1)
+	return 1
+}
+
+// unbounded reports whether Do retries with no limit on the number of
+// attempts, which is the case for WithAttempts(0) and WithFillDeadline.
+func (c *config) unbounded() bool {
+	return c.attempts == 0 || c.fillDeadline
+}
+
+// isLastAttempt reports whether the attempt of the 0-based loop counter n is
+// the last one allowed.
+func (c *config) isLastAttempt(n uint) bool {
+	return !c.unbounded() && n == c.attempts-1
+}
 
-	if cfg.lastErrorOnly {
-		return errs[lastErrIndex]
+// attemptNumber converts the 0-based loop counter into the attempt number
+// reported to callbacks.
+func (c *config) attemptNumber(n uint) uint {
+	if c.oneBasedAttempts {
+		return n + 1
 	}
-	return errs
+	return n
+}
+
+// decide asks the RetryDecisionFn, if one is set, or else the RetryIfFn
+// whether and how to retry after a failed attempt.
+func (c *config) decide(attempt uint, err error) RetryDecision {
+	if len(c.retryOnErrors) > 0 && !isAny(err, c.retryOnErrors) || isAny(err, c.abortOnErrors) {
+		return Stop
+	}
+	if c.matcher != nil && !c.matcher.allows(err) {
+		return Stop
+	}
+	if c.retryDecisionFn != nil {
+		return c.retryDecisionFn(attempt, err)
+	}
+	if !c.retryIfFn(attempt, err) {
+		return Stop
+	}
+	return RetryWithDelay
+}
+
+// nextDelay returns the delay before the attempt following n, along with the
+// raw value the DelayFn computed before clamping.
+func (c *config) nextDelay(n uint, err error) (delay, rawDelay time.Duration) {
+	// only WithDelayFn records the raw delay, the default delayFn is never clamped
+	c.rawDelay = -1
+	delay = c.delayFn(n, err, c)
+	rawDelay = c.rawDelay
+	if rawDelay < 0 {
+		rawDelay = delay
+		delay = c.scaleDelay(delay)
+	}
+	if c.jitterFn != nil {
+		maxDelayTime := c.maxDelayTime
+		if c.maxDelayFn != nil {
+			maxDelayTime = c.maxDelayFn(n)
+		}
+		if jitter := c.jitterFn(n, delay, c); delay > maxDelayTime-jitter {
+			delay = maxDelayTime
+		} else {
+			delay += jitter
+		}
+	}
+	if c.delayGranularity > 0 {
+		delay = delay.Truncate(c.delayGranularity)
+	}
+	if deadline, ok := c.ctx.Deadline(); ok {
+		// no timer needs to outlive the context
+		if remaining := deadline.Sub(c.now()); delay > remaining {
+			delay = remaining
+		}
+	}
+	if c.leaseDeadline != nil {
+		// never sleep past the lease, the next attempt then sees it expired
+		if remaining := c.leaseDeadline().Sub(c.now()); delay > remaining {
+			delay = remaining
+		}
+	}
+	return delay, rawDelay
+}
+
+// scaleDelay applies the WithEnvDelayMultiplier multiplier to delay.
+func (c *config) scaleDelay(delay time.Duration) time.Duration {
+	if c.delayMultiplier == 1 {
+		return delay
+	}
+	return time.Duration(float64(delay) * c.delayMultiplier)
+}
+
+// onSuccess calls the WithOnSuccessFn callback, if any, with the number of
+// attempts Do took to succeed.
+func (c *config) onSuccess(attempts uint) {
+	if c.onSuccessFn != nil {
+		c.onSuccessFn(attempts)
+	}
+}
+
+func isAny(err error, targets []error) bool {
+	for _, target := range targets {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// sleep waits for delay, or returns the context error if the context is done
+// first.
+func (c *config) sleep(delay time.Duration) error {
+	if delay <= 0 {
+		return c.ctx.Err()
+	}
+	if delay < c.spinThreshold {
+		return c.spin(delay)
+	}
+	var shutdown <-chan struct{}
+	if c.shutdownCtx != nil {
+		shutdown = c.shutdownCtx.Done()
+	}
+	var expired <-chan time.Time
+	// when the context is done first, don't race its timer with ours
+	if deadline, ok := c.ctx.Deadline(); !ok || c.now().Add(delay).Before(deadline) {
+		expired = c.clock.After(delay)
+	}
+	select {
+	case <-expired:
+		return nil
+	case <-shutdown:
+		// no point waiting for an attempt that won't start
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
+
+// spin waits for delay without a timer, yielding the processor between checks
+// of the clock and the context.
+func (c *config) spin(delay time.Duration) error {
+	start := c.now()
+	for c.now().Sub(start) < delay {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		runtime.Gosched()
+	}
+	return c.ctx.Err()
+}
+
+const pausePollInterval = 10 * time.Millisecond
+
+// waitWhilePaused blocks as long as the pause signal is raised, or until the
+// context is done.
+func (c *config) waitWhilePaused() error {
+	if !c.pauseSignal() {
+		return nil
+	}
+	for c.pauseSignal() {
+		select {
+		case <-c.clock.After(pausePollInterval):
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+	return nil
+}
+
+// runAttempt calls f once, or races cfg.parallelism copies of it and succeeds
+// as soon as one copy succeeds, cancelling the others. If every copy fails the
+// first error received is returned. It only returns once every copy it
+// started has returned, so no goroutine outlives the attempt.
+func runAttempt(ctx context.Context, f func(context.Context) error, n uint, cfg *config) error {
+	if cfg.enrichErrors || cfg.chronologicalErrors {
+		f = enrich(f, cfg)
+	}
+	if cfg.attemptTimeoutFn != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.attemptTimeoutFn(n))
+		defer cancel()
+	}
+
+	if cfg.parallelism <= 1 {
+		return f(ctx)
+	}
+	return runParallel(ctx, f, cfg.parallelism)
+}
+
+// runParallel races k copies of f. It is apart from runAttempt so that the
+// goroutines capturing ctx and f don't move them to the heap on every
+// attempt.
+func runParallel(ctx context.Context, f func(context.Context) error, k uint) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	results := make(chan error, k)
+	for i := uint(0); i < k; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- f(ctx)
+		}()
+	}
+
+	var firstErr error
+	for i := uint(0); i < k; i++ {
+		err := <-results
+		if err == nil {
+			// stop the other copies before waiting for them
+			cancel()
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// randFloat64, randInt63n and randNormFloat64 draw from the source set by
+// WithRandSource, or from the global one.
+func (c *config) randFloat64() float64 {
+	if c.rand == nil {
+		return rand.Float64()
+	}
+	return c.rand.Float64()
+}
+
+func (c *config) randInt63n(n int64) int64 {
+	if c.rand == nil {
+		return rand.Int63n(n)
+	}
+	return c.rand.Int63n(n)
+}
+
+func (c *config) randNormFloat64() float64 {
+	if c.rand == nil {
+		return rand.NormFloat64()
+	}
+	return c.rand.NormFloat64()
+}
+
+func newConfig(opts ...Option) *config {
+	cfg := newDefaultConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
 }
 
 func newDefaultConfig() *config {
 	return &config{
-		attempts:     defaultAttempts,
-		onRetryFn:    defaultOnRetryFn,
-		retryIfFn:    defaultRetryIfFn,
-		delayFn:      defaultDelayFn,
-		maxDelayTime: time.Duration(1<<63 - 1),
-		ctx:          context.Background(),
+		attempts:              defaultAttempts,
+		onRetryFn:             defaultOnRetryFn,
+		retryIfFn:             defaultRetryIfFn,
+		retryIfWithDurationFn: defaultRetryIfWithDurationFn,
+		delayFn:               defaultDelayFn,
+		baseDelayFn:           defaultDelayFn,
+		maxDelayTime:          time.Duration(1<<63 - 1),
+		ctx:                   context.Background(),
+		clock:                 realClock{},
+		logger:                noopLogger{},
+		reporter:              noopReporter{},
+		delayMultiplier:       1,
 	}
 }
@@ -4,10 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/nickchenyx/retry-go-dummy/retrytest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -61,6 +67,42 @@ func TestUnRecoverableError(t *testing.T) {
 	assert.Equal(t, expectErr, err)
 }
 
+func TestRetryIfFnGetsUnrecoverableError(t *testing.T) {
+	expectErr := errors.New("error")
+	var sawUnrecoverable []bool
+	err := Do(func() error {
+		if len(sawUnrecoverable) == 0 {
+			return expectErr
+		}
+		return fmt.Errorf("wrapped: %w", UnrecoverableError(expectErr))
+	}, WithRetryIfFn(func(n uint, err error) bool {
+		unrecoverable := IsUnrecoverableError(err)
+		sawUnrecoverable = append(sawUnrecoverable, unrecoverable)
+		return !unrecoverable
+	}))
+
+	assert.Equal(t, []bool{false, true}, sawUnrecoverable, "predicate should see the error as returned by f")
+	assert.EqualError(t, err, `Retry Error: 
+# 0: error
+# 1: error`)
+}
+
+func TestSideEffectError(t *testing.T) {
+	var calls uint
+	expectErr := errors.New("error")
+	err := Do(func() error {
+		calls++
+		return SideEffectError(expectErr)
+	}, WithRetryIfFn(func(n uint, err error) bool {
+		return true
+	}), WithLastErrorOnly(true))
+
+	assert.Equal(t, uint(1), calls, "side effect started, shouldn't retry")
+	assert.Equal(t, expectErr, err)
+	assert.True(t, IsSideEffectError(fmt.Errorf("wrapped: %w", SideEffectError(expectErr))))
+	assert.False(t, IsUnrecoverableError(SideEffectError(expectErr)))
+}
+
 func TestContextCanceled(t *testing.T) {
 	t.Run("context canceled", func(t *testing.T) {
 		cancelCtx, cancel := context.WithCancel(context.Background())
@@ -95,7 +137,6 @@ func TestContextCanceled(t *testing.T) {
 }
 
 func TestDoFixDelayFn(t *testing.T) {
-	start := time.Now()
 	attempts := uint(2)
 	expectRetryNum := uint(1)
 	delayTime := time.Duration(100 * time.Millisecond)
@@ -103,18 +144,32 @@ func TestDoFixDelayFn(t *testing.T) {
 	expectErr := errors.New("error")
 
 	t.Run("fix delay", func(t *testing.T) {
-		err := Do(func() error {
-			return expectErr
-		}, WithDelayFn(FixDelayFn, SetFixTimeFn(delayTime)),
-			WithOnRetryFn(func(u uint, e error) {
-				retryNum = u
-			}),
-			WithLastErrorOnly(true),
-			WithAttempts(attempts))
+		clock := retrytest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		start := clock.Now()
+		done := make(chan error, 1)
+		go func() {
+			done <- Do(func() error {
+				return expectErr
+			}, WithDelayFn(FixDelayFn, SetFixTimeFn(delayTime)),
+				WithOnRetryFn(func(u uint, e error) {
+					retryNum = u
+				}),
+				WithLastErrorOnly(true),
+				WithAttempts(attempts),
+				WithClock(clock))
+		}()
+
+		clock.BlockUntil(1)
+		select {
+		case <-done:
+			t.Fatal("should wait for the delay before retrying")
+		default:
+		}
+		clock.Advance(delayTime)
+		err := <-done
 
 		assert.Equal(t, expectRetryNum, retryNum, fmt.Sprintf("should retry %v time", attempts))
-		// assert.LessOrEqual(t, time.Duration(int64(attempts)*int64(delayTime)), time.Since(start))
-		assert.True(t, time.Now().After(start.Add(time.Duration(int64(attempts-1)*int64(delayTime)))), fmt.Sprintf("shoud run more than %v ms", int64(attempts-1)*int64(delayTime/time.Millisecond)))
+		assert.Equal(t, time.Duration(attempts-1)*delayTime, clock.Now().Sub(start))
 		assert.Equal(t, expectErr, err)
 	})
 }
@@ -201,3 +256,1930 @@ func TestErrorAs(t *testing.T) {
 	assert.False(t, errors.As(e, &tb))
 	assert.Equal(t, "foo", tf.str)
 }
+
+func TestErrorUnwrap(t *testing.T) {
+	expectErr := errors.New("error")
+	e := Error{fooErr{str: "foo"}, fmt.Errorf("wrapped: %w", expectErr)}
+
+	assert.Equal(t, []error(e), e.Unwrap())
+	joined := errors.Join(errors.New("other"), e)
+	assert.True(t, errors.Is(joined, expectErr), "errors.Is should look through a joined Error")
+	var tf fooErr
+	assert.True(t, errors.As(joined, &tf))
+}
+
+func TestCapSmoothing(t *testing.T) {
+	beginTime := 10 * time.Millisecond
+	maxDelayTime := 100 * time.Millisecond
+	fraction := 0.25
+
+	cfg := newDefaultConfig()
+	WithDelayFn(BackOffDelayFn, SetBackOffBeginTimeFn(beginTime), SetMaxDelayTimeFn(maxDelayTime))(cfg)
+	WithCapSmoothing(fraction)(cfg)
+
+	for n := uint(0); n < 4; n++ {
+		assert.Equal(t, beginTime<<n, cfg.delayFn(n, nil, cfg), "pre-cap delay should be exact")
+	}
+
+	lower := time.Duration(float64(maxDelayTime) * (1 - fraction))
+	upper := time.Duration(float64(maxDelayTime) * (1 + fraction))
+	seen := map[time.Duration]bool{}
+	for n := uint(4); n < 100; n++ {
+		d := cfg.delayFn(n, nil, cfg)
+		assert.True(t, d >= lower && d <= upper, fmt.Sprintf("clamped delay %v should be within [%v, %v]", d, lower, upper))
+		seen[d] = true
+	}
+	assert.True(t, len(seen) > 1, "clamped delays should vary")
+}
+
+type detailedErr struct{ str string }
+
+func (e detailedErr) Error() string {
+	return e.str
+}
+
+func (e detailedErr) Format(s fmt.State, verb rune) {
+	if verb == 'v' && s.Flag('+') {
+		fmt.Fprintf(s, "%v\n\tat stack", e.str)
+		return
+	}
+	fmt.Fprint(s, e.str)
+}
+
+func TestErrorFormat(t *testing.T) {
+	e := Error{errors.New("error"), detailedErr{str: "detailed"}}
+
+	compact := `Retry Error: 
+# 0: error
+# 1: detailed`
+	detailed := `Retry Error: 
+# 0: error
+# 1: detailed
+	at stack`
+
+	assert.Equal(t, compact, fmt.Sprintf("%v", e))
+	assert.Equal(t, compact, fmt.Sprintf("%s", e))
+	assert.Equal(t, detailed, fmt.Sprintf("%+v", e))
+	assert.Equal(t, compact, fmt.Sprintf("%d", e), "other verbs should print the compact form")
+}
+
+func TestDoRetryIfWithDuration(t *testing.T) {
+	slowThreshold := 50 * time.Millisecond
+	retryIfFast := WithRetryIfWithDurationFn(func(n uint, err error, d time.Duration) bool {
+		return d < slowThreshold
+	})
+
+	t.Run("fast failures keep retrying", func(t *testing.T) {
+		var calls uint
+		attempts := uint(5)
+		_ = Do(func() error {
+			calls++
+			return errors.New("error")
+		}, retryIfFast, WithAttempts(attempts))
+
+		assert.Equal(t, attempts, calls, fmt.Sprintf("should run %v times", attempts))
+	})
+
+	t.Run("slow failure stops", func(t *testing.T) {
+		var calls uint
+		err := Do(func() error {
+			calls++
+			if calls == 2 {
+				time.Sleep(2 * slowThreshold)
+			}
+			return errors.New("error")
+		}, retryIfFast, WithAttempts(5), WithLastErrorOnly(true))
+
+		assert.Equal(t, uint(2), calls, "should stop after the slow attempt")
+		assert.EqualError(t, err, "error")
+	})
+}
+
+func TestDoWithContextParallelism(t *testing.T) {
+	var calls, cancelled int32
+	err := DoWithContext(context.Background(), func(ctx context.Context) error {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			return nil
+		}
+		<-ctx.Done()
+		atomic.AddInt32(&cancelled, 1)
+		return ctx.Err()
+	}, WithParallelism(3))
+
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) == 3 && atomic.LoadInt32(&cancelled) == 2
+	}, time.Second, time.Millisecond, "should run 3 copies and cancel the losing ones")
+}
+
+func TestDoWithContextParallelismRetriesRound(t *testing.T) {
+	var calls int32
+	err := DoWithContext(context.Background(), func(ctx context.Context) error {
+		if atomic.AddInt32(&calls, 1) <= 3 {
+			return errors.New("error")
+		}
+		return nil
+	}, WithParallelism(3))
+
+	assert.NoError(t, err)
+	assert.True(t, atomic.LoadInt32(&calls) > 3, "should retry the whole round after every copy failed")
+}
+
+type retryAtErr struct{ at time.Time }
+
+func (e retryAtErr) Error() string {
+	return fmt.Sprintf("retry at %v", e.at)
+}
+
+func TestAbsoluteTimeDelayFn(t *testing.T) {
+	extract := func(err error) (time.Time, bool) {
+		var e retryAtErr
+		if errors.As(err, &e) {
+			return e.at, true
+		}
+		return time.Time{}, false
+	}
+	skew := 500 * time.Millisecond
+	df := AbsoluteTimeDelayFn(extract, skew)
+	cfg := newDefaultConfig()
+
+	d := df(0, retryAtErr{at: time.Now().Add(2 * time.Second)}, cfg)
+	assert.True(t, d > 2*time.Second+skew-100*time.Millisecond && d <= 2*time.Second+skew, fmt.Sprintf("delay %v should account for the skew", d))
+
+	d = df(0, retryAtErr{at: time.Now().Add(-2 * time.Second)}, cfg)
+	assert.Equal(t, time.Duration(0), d, "past timestamp should not produce a negative delay")
+
+	d = df(0, errors.New("error"), cfg)
+	assert.Equal(t, time.Duration(0), d, "error without timestamp should not delay")
+}
+
+func TestDoStopOnRepeatedError(t *testing.T) {
+	errA := errors.New("a")
+	errB := errors.New("b")
+	var calls uint
+	err := Do(func() error {
+		calls++
+		if calls%2 == 1 {
+			return fmt.Errorf("wrapped: %w", errA)
+		}
+		return errB
+	}, WithStopOnRepeatedError(3))
+
+	expectedErr := `Retry Error: 
+# 0: wrapped: a
+# 1: b
+# 2: wrapped: a
+# 3: b
+# 4: wrapped: a`
+	assert.Equal(t, uint(5), calls, "should stop when a occurs the third time")
+	assert.EqualError(t, err, expectedErr)
+}
+
+func TestAlignedDelayFn(t *testing.T) {
+	cfg := newDefaultConfig()
+	clock := retrytest.NewFakeClock(time.Date(2022, 6, 1, 12, 0, 17, int(250*time.Millisecond), time.UTC))
+	cfg.clock = clock
+	df := AlignedDelayFn(30 * time.Second)
+
+	d := df(0, nil, cfg)
+	assert.Equal(t, 12*time.Second+750*time.Millisecond, d)
+	assert.Equal(t, time.Date(2022, 6, 1, 12, 0, 30, 0, time.UTC), clock.Now().Add(d), "should reach the next boundary exactly")
+
+	clock.Advance(d)
+	assert.Equal(t, 30*time.Second, df(1, nil, cfg), "on a boundary should wait for the next one")
+}
+
+func TestDoResultLatency(t *testing.T) {
+	var result DoResult
+	var calls int
+	err := Do(func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("error")
+		}
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}, WithDelayFn(FixDelayFn, SetFixTimeFn(100*time.Millisecond)), WithDoResult(&result))
+
+	assert.NoError(t, err)
+	assert.True(t, result.SuccessAttemptDuration >= 50*time.Millisecond && result.SuccessAttemptDuration < 100*time.Millisecond,
+		fmt.Sprintf("successful attempt took %v", result.SuccessAttemptDuration))
+	assert.True(t, result.TotalElapsed >= 250*time.Millisecond, fmt.Sprintf("total elapsed %v should include the delays", result.TotalElapsed))
+}
+
+func TestDoResultRawDelays(t *testing.T) {
+	var result DoResult
+	beginTime := time.Millisecond
+	maxDelayTime := 4 * time.Millisecond
+	_ = Do(func() error {
+		return errors.New("error")
+	}, WithDelayFn(BackOffDelayFn, SetBackOffBeginTimeFn(beginTime), SetMaxDelayTimeFn(maxDelayTime)),
+		WithAttempts(6),
+		WithDoResult(&result))
+
+	assert.Equal(t, []time.Duration{1, 2, 4, 8, 16}, scaleDurations(result.RawDelays, beginTime))
+	assert.Equal(t, []time.Duration{1, 2, 4, 4, 4}, scaleDurations(result.Delays, beginTime))
+	for i := range result.Delays {
+		if result.RawDelays[i] > maxDelayTime {
+			assert.Equal(t, maxDelayTime, result.Delays[i], "delay over the cap should be clamped")
+		}
+	}
+}
+
+func scaleDurations(ds []time.Duration, unit time.Duration) []time.Duration {
+	res := make([]time.Duration, len(ds))
+	for i, d := range ds {
+		res[i] = d / unit
+	}
+	return res
+}
+
+type statusErr struct{ code int }
+
+func (e statusErr) Error() string {
+	return fmt.Sprintf("status %d", e.code)
+}
+
+func TestBackoffByClassifier(t *testing.T) {
+	classify := func(err error) string {
+		var se statusErr
+		if errors.As(err, &se) {
+			return fmt.Sprint(se.code)
+		}
+		return ""
+	}
+	constDelayFn := func(d time.Duration) DelayFn {
+		return func(uint, error, *config) time.Duration { return d }
+	}
+
+	cfg := newDefaultConfig()
+	WithDelayFn(constDelayFn(10 * time.Millisecond))(cfg)
+	WithBackoffByClassifier(classify, map[string]DelayFn{
+		"429": BackOffDelayFn,
+		"503": constDelayFn(50 * time.Millisecond),
+	}, SetBackOffBeginTimeFn(100*time.Millisecond))(cfg)
+
+	assert.Equal(t, 400*time.Millisecond, cfg.delayFn(2, statusErr{code: 429}, cfg), "429 should back off aggressively")
+	assert.Equal(t, 50*time.Millisecond, cfg.delayFn(2, statusErr{code: 503}, cfg), "503 should back off moderately")
+	assert.Equal(t, 10*time.Millisecond, cfg.delayFn(2, statusErr{code: 500}, cfg), "others should use the previous delay")
+}
+
+func TestBackoffByClassifierDelayMultiplier(t *testing.T) {
+	varName := "RETRY_TEST_DELAY_MULTIPLIER"
+	t.Setenv(varName, "2.0")
+	cfg := newConfig(
+		WithDelay(10*time.Millisecond),
+		WithEnvDelayMultiplier(varName),
+		WithBackoffByClassifier(func(error) string { return "" }, nil),
+	)
+
+	delay, rawDelay := cfg.nextDelay(0, errors.New("error"))
+	assert.Equal(t, 20*time.Millisecond, delay, "the fallback should be scaled once")
+	assert.Equal(t, 10*time.Millisecond, rawDelay)
+}
+
+func TestDoResultStopReason(t *testing.T) {
+	t.Run("succeeded", func(t *testing.T) {
+		var result DoResult
+		_ = Do(func() error { return nil }, WithDoResult(&result))
+		assert.Equal(t, Succeeded, result.StopReason)
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		var result DoResult
+		_ = Do(func() error { return errors.New("error") }, WithAttempts(3), WithDoResult(&result))
+		assert.Equal(t, AttemptsExhausted, result.StopReason)
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		var result DoResult
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_ = Do(func() error {
+			return errors.New("error")
+		}, WithDelayFn(FixDelayFn, SetFixTimeFn(time.Second)), WithContext(ctx), WithDoResult(&result))
+		assert.Equal(t, ContextCancelled, result.StopReason)
+	})
+
+	t.Run("aborted", func(t *testing.T) {
+		var result DoResult
+		_ = Do(func() error {
+			return UnrecoverableError(errors.New("error"))
+		}, WithDoResult(&result))
+		assert.Equal(t, Aborted, result.StopReason)
+	})
+}
+
+func TestOneBasedAttempts(t *testing.T) {
+	var retried, asked []uint
+	err := Do(func() error {
+		return errors.New("error")
+	}, WithOnRetryFn(func(n uint, e error) {
+		retried = append(retried, n)
+	}), WithRetryIfFn(func(n uint, e error) bool {
+		asked = append(asked, n)
+		return true
+	}), WithAttempts(3), WithOneBasedAttempts(true))
+
+	expectedErr := `Retry Error: 
+# 1: error
+# 2: error
+# 3: error`
+	assert.Equal(t, []uint{1, 2, 3}, retried)
+	assert.Equal(t, []uint{1, 2, 3}, asked)
+	assert.EqualError(t, err, expectedErr)
+}
+
+func TestAttemptError(t *testing.T) {
+	err := Do(func() error {
+		return io.EOF
+	}, WithAttempts(2), WithDelay(0), WithOneBasedAttempts(true))
+
+	e := err.(Error)
+	assert.Equal(t, AttemptError{Err: io.EOF, Attempt: 0, OneBased: true}, e[0])
+	assert.Equal(t, []error{io.EOF, io.EOF}, e.WrappedErrors())
+	assert.True(t, errors.Is(err, io.EOF))
+}
+
+func TestDoPauseSignal(t *testing.T) {
+	pauseTime := 100 * time.Millisecond
+	var paused int32 = 1
+	time.AfterFunc(pauseTime, func() {
+		atomic.StoreInt32(&paused, 0)
+	})
+
+	var calls []time.Time
+	start := time.Now()
+	err := Do(func() error {
+		calls = append(calls, time.Now())
+		if len(calls) < 2 {
+			return errors.New("error")
+		}
+		return nil
+	}, WithPauseSignal(func() bool {
+		return atomic.LoadInt32(&paused) == 1
+	}))
+
+	assert.NoError(t, err)
+	assert.Len(t, calls, 2)
+	assert.True(t, calls[0].Sub(start) < pauseTime, "first attempt shouldn't wait for the pause")
+	assert.True(t, calls[1].Sub(start) >= pauseTime, "retry should wait until resumed")
+
+	t.Run("context canceled while paused", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := Do(func() error {
+			return errors.New("error")
+		}, WithPauseSignal(func() bool { return true }), WithContext(ctx), WithLastErrorOnly(true))
+
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+}
+
+func TestDoRetryDecisionFn(t *testing.T) {
+	errNow := errors.New("retry now")
+	errFatal := errors.New("fatal")
+	delayTime := 100 * time.Millisecond
+
+	var calls []time.Time
+	err := Do(func() error {
+		calls = append(calls, time.Now())
+		switch len(calls) {
+		case 1:
+			return errNow
+		case 2:
+			return errors.New("error")
+		}
+		return errFatal
+	}, WithRetryDecisionFn(func(n uint, err error) RetryDecision {
+		switch err {
+		case errNow:
+			return RetryNow
+		case errFatal:
+			return Stop
+		}
+		return RetryWithDelay
+	}), WithDelayFn(FixDelayFn, SetFixTimeFn(delayTime)), WithLastErrorOnly(true))
+
+	assert.Equal(t, errFatal, err)
+	assert.Len(t, calls, 3, "should stop on the fatal error")
+	assert.True(t, calls[1].Sub(calls[0]) < delayTime/2, "RetryNow should skip the delay")
+	assert.True(t, calls[2].Sub(calls[1]) >= delayTime, "RetryWithDelay should wait for the delay")
+}
+
+func TestWindowedBackoffDelayFn(t *testing.T) {
+	perFailure := 10 * time.Millisecond
+	df := WindowedBackoffDelayFn(time.Minute, perFailure)
+	cfg := newDefaultConfig()
+	clock := retrytest.NewFakeClock(time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC))
+	cfg.clock = clock
+
+	var delays []time.Duration
+	for _, offset := range []time.Duration{0, time.Second, 2 * time.Second, 30 * time.Second} {
+		clock.Advance(offset)
+		delays = append(delays, df(0, nil, cfg))
+	}
+	assert.Equal(t, []time.Duration{1, 2, 3, 4}, scaleDurations(delays, perFailure), "delay should grow with a burst of failures")
+
+	clock.Advance(40 * time.Second)
+	assert.Equal(t, 2*perFailure, df(0, nil, cfg), "failures older than the window should age out")
+}
+
+func TestDoOnContextDone(t *testing.T) {
+	t.Run("cancelled mid-run", func(t *testing.T) {
+		var called int32
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		err := Do(func() error {
+			return errors.New("error")
+		}, WithDelayFn(FixDelayFn, SetFixTimeFn(time.Second)),
+			WithContext(ctx),
+			WithOnContextDone(func() { atomic.AddInt32(&called, 1) }),
+			WithLastErrorOnly(true))
+
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&called), "cleanup should be done when Do returns")
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&called), "cleanup should run exactly once")
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var called int32
+		ctx, cancel := context.WithCancel(context.Background())
+
+		err := Do(func() error {
+			return nil
+		}, WithContext(ctx), WithOnContextDone(func() { atomic.AddInt32(&called, 1) }))
+		cancel()
+
+		assert.NoError(t, err)
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&called), "cleanup shouldn't run after success")
+	})
+
+	t.Run("slow cleanup", func(t *testing.T) {
+		var finished int32
+		ctx, cancel := context.WithCancel(context.Background())
+		err := Do(func() error {
+			cancel()
+			return errors.New("error")
+		}, WithContext(ctx), WithOnContextDone(func() {
+			time.Sleep(50 * time.Millisecond)
+			atomic.StoreInt32(&finished, 1)
+		}))
+
+		assert.Error(t, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&finished), "Do should wait for a started cleanup")
+	})
+}
+
+func TestDoErrorSummaryOnly(t *testing.T) {
+	var calls int
+	err := Do(func() error {
+		calls++
+		return fmt.Errorf("error %d", calls)
+	}, WithErrorSummaryOnly(true))
+
+	expectedErr := `Retry Error: 
+# 0: error 1
+# 9: error 10`
+	assert.EqualError(t, err, expectedErr)
+	var e Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, defaultAttempts, e.Attempts())
+	assert.Len(t, e.WrappedErrors(), 2)
+}
+
+func BenchmarkDoErrorRetention(b *testing.B) {
+	expectErr := errors.New("error")
+	f := func() error { return expectErr }
+	attempts := uint(1000)
+
+	b.Run("full", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = Do(f, WithAttempts(attempts))
+		}
+	})
+
+	b.Run("summary", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = Do(f, WithAttempts(attempts), WithErrorSummaryOnly(true))
+		}
+	})
+}
+
+func TestDoInjectFailures(t *testing.T) {
+	injected := errors.New("injected")
+	var calls uint
+	var retried []error
+	err := Do(func() error {
+		calls++
+		return nil
+	}, WithInjectFailures(3, injected), WithOnRetryFn(func(n uint, err error) {
+		retried = append(retried, err)
+	}))
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint(4), calls, "f should succeed once the injected failures are used up")
+	assert.Equal(t, []error{injected, injected, injected}, retried)
+}
+
+func TestAutoBackoff(t *testing.T) {
+	deadline := 10 * time.Second
+	cfg := newDefaultConfig()
+	WithAutoBackoff(deadline)(cfg)
+
+	var total time.Duration
+	for n := uint(0); n < cfg.attempts-1; n++ {
+		total += cfg.delayFn(n, nil, cfg)
+	}
+	assert.True(t, total <= deadline, fmt.Sprintf("cumulative delay %v should fit in %v", total, deadline))
+	assert.True(t, total+cfg.delayFn(cfg.attempts-1, nil, cfg) > deadline, "one more attempt shouldn't fit")
+	assert.Equal(t, uint(8), cfg.attempts)
+	assert.Equal(t, deadline/100, cfg.delayFn(0, nil, cfg))
+	assert.Equal(t, deadline/4, cfg.delayFn(cfg.attempts-2, nil, cfg))
+}
+
+func TestAutoBackoffTinyDeadline(t *testing.T) {
+	for _, deadline := range []time.Duration{0, 1, 3} {
+		cfg := newDefaultConfig()
+		WithAutoBackoff(deadline)(cfg)
+		assert.Equal(t, uint(1), cfg.attempts, fmt.Sprintf("a %v deadline should leave a single attempt", deadline))
+	}
+
+	cfg := newDefaultConfig()
+	WithAutoBackoff(4)(cfg)
+	assert.True(t, cfg.attempts > 1, "a deadline fitting a delay should allow retries")
+}
+
+func TestLastChanceDelayFn(t *testing.T) {
+	delayTime := 200 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var result DoResult
+	var calls int
+	err := Do(func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("error")
+		}
+		return nil
+	}, WithDelayFn(LastChanceDelayFn(FixDelayFn), SetFixTimeFn(delayTime)),
+		WithContext(ctx),
+		WithAttempts(3),
+		WithDoResult(&result))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{delayTime, 0}, result.Delays, "the delay before the last attempt should be zeroed")
+	assert.True(t, result.TotalElapsed < 300*time.Millisecond, fmt.Sprintf("took %v", result.TotalElapsed))
+}
+
+func TestPolynomialDelayFn(t *testing.T) {
+	base := time.Millisecond
+	cfg := newDefaultConfig()
+	WithDelayFn(PolynomialDelayFn(2), SetFixTimeFn(base), SetMaxDelayTimeFn(20*base))(cfg)
+
+	var delays []time.Duration
+	for n := uint(0); n < 7; n++ {
+		delays = append(delays, cfg.delayFn(n, nil, cfg))
+	}
+	assert.Equal(t, []time.Duration{0, 1, 4, 9, 16, 20, 20}, scaleDurations(delays, base))
+	assert.Equal(t, 20*base, cfg.delayFn(1<<40, nil, cfg), "huge attempts shouldn't overflow")
+}
+
+func TestDoWithContextEscalatingAttemptTimeout(t *testing.T) {
+	base := 100 * time.Millisecond
+	var timeouts []time.Duration
+	_ = DoWithContext(context.Background(), func(ctx context.Context) error {
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok, "attempt context should have a deadline")
+		timeouts = append(timeouts, time.Until(deadline))
+		return errors.New("error")
+	}, WithEscalatingAttemptTimeout(base, 2), WithAttempts(4))
+
+	assert.Len(t, timeouts, 4)
+	for n, timeout := range timeouts {
+		expected := base << uint(n)
+		assert.True(t, timeout <= expected && timeout > expected-20*time.Millisecond,
+			fmt.Sprintf("attempt %v timeout %v should be about %v", n, timeout, expected))
+	}
+}
+
+func TestDoErrorSampleRate(t *testing.T) {
+	attempts := uint(1000)
+	var calls int
+	err := Do(func() error {
+		calls++
+		return fmt.Errorf("error %d", calls)
+	}, WithAttempts(attempts), WithErrorSampleRate(100))
+
+	var e Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, attempts, e.Attempts(), "should count every failed attempt")
+	assert.Len(t, e.WrappedErrors(), 11, "should keep every 100th error and the last one")
+	assert.EqualError(t, e.WrappedErrors()[1], "error 101")
+	assert.EqualError(t, e.WrappedErrors()[10], "error 1000")
+	assert.Contains(t, err.Error(), "# 999: error 1000")
+}
+
+func TestBackOffFactorRange(t *testing.T) {
+	base := time.Millisecond
+	minFactor, maxFactor := 1.8, 2.2
+	cfg := newDefaultConfig()
+	WithDelayFn(BackOffDelayFn, SetBackOffBeginTimeFn(base), SetBackOffFactorRangeFn(minFactor, maxFactor))(cfg)
+
+	for n := uint(1); n < 8; n++ {
+		lower := time.Duration(float64(base) * math.Pow(minFactor, float64(n)))
+		upper := time.Duration(float64(base) * math.Pow(maxFactor, float64(n)))
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 200; i++ {
+			d := cfg.delayFn(n, nil, cfg)
+			assert.True(t, d >= lower && d <= upper, fmt.Sprintf("attempt %v delay %v should be within [%v, %v]", n, d, lower, upper))
+			seen[d] = true
+		}
+		assert.True(t, len(seen) > 1, "the factor should vary")
+	}
+}
+
+func TestBackOffFactorRangePerStep(t *testing.T) {
+	maxDelay := 500 * time.Millisecond
+	cfg := newConfig(WithDelayFn(BackOffDelayFn, SetBackOffBeginTimeFn(time.Millisecond), SetBackOffFactorRangeFn(1.8, 2.2), SetMaxDelayTimeFn(maxDelay)))
+
+	for run := 0; run < 50; run++ {
+		var prev time.Duration
+		for n := uint(0); n < 15; n++ {
+			d := BackOffDelayFn(n, nil, cfg)
+			assert.True(t, d >= prev, fmt.Sprintf("delay %v of attempt %v should not shrink from %v", d, n, prev))
+			assert.True(t, d <= maxDelay, fmt.Sprintf("delay %v should be capped at %v", d, maxDelay))
+			if n > 0 && prev < maxDelay {
+				ratio := float64(d) / float64(prev)
+				assert.True(t, d == maxDelay || ratio >= 1.79 && ratio <= 2.21, fmt.Sprintf("step %v grew by %v", n, ratio))
+			}
+			prev = d
+		}
+	}
+
+	assert.Panics(t, func() { SetBackOffFactorRangeFn(2.2, 1.8) })
+	assert.Panics(t, func() { SetBackOffFactorRangeFn(0.5, 2) })
+}
+
+func TestEnvDelayMultiplier(t *testing.T) {
+	varName := "RETRY_TEST_DELAY_MULTIPLIER"
+	delayTime := 100 * time.Millisecond
+	delayFor := func() time.Duration {
+		cfg := newConfig(WithDelayFn(FixDelayFn, SetFixTimeFn(delayTime)), WithEnvDelayMultiplier(varName))
+		delay, _ := cfg.nextDelay(0, nil)
+		return delay
+	}
+
+	assert.Equal(t, delayTime, delayFor(), "unset variable shouldn't change delays")
+
+	t.Setenv(varName, "2.0")
+	assert.Equal(t, 2*delayTime, delayFor(), "delays should double")
+
+	t.Setenv(varName, "garbage")
+	assert.Equal(t, delayTime, delayFor(), "unparsable value shouldn't change delays")
+}
+
+func TestEnvDelayMultiplierMaxDelay(t *testing.T) {
+	varName := "RETRY_TEST_DELAY_MULTIPLIER"
+	t.Setenv(varName, "3.0")
+	cfg := newConfig(
+		WithDelayFn(FixDelayFn, SetFixTimeFn(100*time.Millisecond), SetMaxDelayTimeFn(200*time.Millisecond)),
+		WithEnvDelayMultiplier(varName),
+	)
+
+	delay, rawDelay := cfg.nextDelay(0, nil)
+	assert.Equal(t, 200*time.Millisecond, delay, "the multiplied delay should be clamped to the max delay")
+	assert.Equal(t, 100*time.Millisecond, rawDelay)
+}
+
+func TestGaussianJitterFn(t *testing.T) {
+	base := 100 * time.Millisecond
+	stddev := 10 * time.Millisecond
+	cfg := newDefaultConfig()
+	SetFixTimeFn(base)(cfg)
+	df := GaussianJitterFn(stddev)
+
+	const samples = 10000
+	var sum, sumSquares float64
+	for i := 0; i < samples; i++ {
+		delay := float64(df(0, nil, cfg))
+		sum += delay
+		sumSquares += delay * delay
+	}
+	mean := sum / samples
+	spread := math.Sqrt(sumSquares/samples - mean*mean)
+
+	assert.InDelta(t, float64(base), mean, float64(time.Millisecond), "mean should be near the base delay")
+	assert.InDelta(t, float64(stddev), spread, float64(time.Millisecond), "spread should match the stddev")
+}
+
+func TestGaussianJitterFnNonNegative(t *testing.T) {
+	cfg := newDefaultConfig()
+	SetFixTimeFn(time.Millisecond)(cfg)
+	df := GaussianJitterFn(time.Second)
+	for i := 0; i < 1000; i++ {
+		assert.True(t, df(0, nil, cfg) >= 0, "delay shouldn't be negative")
+	}
+}
+
+func TestTieredMaxDelay(t *testing.T) {
+	cfg := newConfig(
+		WithDelayFn(FixDelayFn, SetFixTimeFn(time.Minute)),
+		WithTieredMaxDelay(func(n uint) time.Duration {
+			if n < 3 {
+				return time.Second
+			}
+			return 10 * time.Second
+		}),
+	)
+
+	expected := []time.Duration{time.Second, time.Second, time.Second, 10 * time.Second, 10 * time.Second}
+	for n, want := range expected {
+		delay, rawDelay := cfg.nextDelay(uint(n), nil)
+		assert.Equal(t, want, delay, fmt.Sprintf("cap after attempt %d", n))
+		assert.Equal(t, time.Minute, rawDelay)
+	}
+}
+
+type evenAttemptsAccumulator struct {
+	errs []error
+}
+
+func (a *evenAttemptsAccumulator) Record(n uint, err error) {
+	if n%2 == 0 {
+		a.errs = append(a.errs, err)
+	}
+}
+
+func (a *evenAttemptsAccumulator) Result() error {
+	return errors.Join(a.errs...)
+}
+
+func TestErrorAccumulator(t *testing.T) {
+	acc := &evenAttemptsAccumulator{}
+	var calls int
+	err := Do(func() error {
+		calls++
+		return fmt.Errorf("error %d", calls-1)
+	}, WithAttempts(5), WithErrorAccumulator(acc), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	assert.Error(t, err)
+	assert.Equal(t, "error 0\nerror 2\nerror 4", err.Error())
+	assert.Len(t, acc.errs, 3)
+}
+
+func TestErrorAccumulatorContextError(t *testing.T) {
+	acc := &evenAttemptsAccumulator{}
+	ctx, cancel := context.WithCancel(context.Background())
+	err := Do(func() error {
+		cancel()
+		return errors.New("error")
+	}, WithContext(ctx), WithAttempts(5), WithErrorAccumulator(acc))
+
+	assert.True(t, errors.Is(err, context.Canceled), "the context error should be recorded for the last attempt")
+}
+
+func TestResultRetryIf(t *testing.T) {
+	var calls int
+	data, err := DoWithData(func() (int, error) {
+		calls++
+		return calls, nil
+	}, WithResultRetryIf(func(data int) bool { return data < 3 }), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, data)
+
+	_, err = DoWithData(func() (int, error) {
+		return 0, nil
+	}, WithResultRetryIf(func(data int) bool { return true }), WithAttempts(2), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+	assert.True(t, errors.Is(err, ErrResultRejected))
+}
+
+func TestClusterSeed(t *testing.T) {
+	jitter := func(opt Option) []time.Duration {
+		cfg := newConfig(WithDelayFn(RandomDelayFn, SetRamdomTimeFn(time.Second)), opt)
+		var delays []time.Duration
+		for n := uint(0); n < 5; n++ {
+			delay, _ := cfg.nextDelay(n, nil)
+			delays = append(delays, delay)
+		}
+		return delays
+	}
+	nodeID := func(id int64) func() int64 {
+		return func() int64 { return id }
+	}
+
+	assert.Equal(t, jitter(WithClusterSeed(42, nil)), jitter(WithClusterSeed(42, nil)), "nodes without spread should retry together")
+	assert.Equal(t, jitter(WithClusterSeed(42, nodeID(1))), jitter(WithClusterSeed(42, nodeID(1))), "the same node id should get the same jitter")
+	assert.NotEqual(t, jitter(WithClusterSeed(42, nodeID(1))), jitter(WithClusterSeed(42, nodeID(2))), "different node ids should spread out")
+}
+
+func TestSpinForDelaysBelow(t *testing.T) {
+	cfg := newConfig(WithSpinForDelaysBelow(time.Millisecond))
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, cfg.sleep(100*time.Microsecond))
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 10*time.Millisecond, fmt.Sprintf("spinning should wait for the delay, took %v", elapsed))
+	assert.True(t, elapsed < 100*time.Millisecond, fmt.Sprintf("sub-threshold delays should complete promptly, took %v", elapsed))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cfg = newConfig(WithSpinForDelaysBelow(time.Second), WithContext(ctx))
+	start = time.Now()
+	assert.Equal(t, context.Canceled, cfg.sleep(500*time.Millisecond))
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "spinning should stop on context cancellation")
+}
+
+func TestSpinForDelaysBelowFakeClock(t *testing.T) {
+	clock := retrytest.NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	cfg := newConfig(WithSpinForDelaysBelow(time.Second), WithClock(clock), WithContext(ctx))
+	assert.Equal(t, context.Canceled, cfg.sleep(20*time.Millisecond), "spinning should wait for the clock, not the real time")
+
+	cfg = newConfig(WithSpinForDelaysBelow(time.Second), WithClock(clock))
+	done := make(chan error, 1)
+	go func() {
+		done <- cfg.sleep(20 * time.Millisecond)
+	}()
+	for {
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+			return
+		case <-time.After(time.Millisecond):
+			clock.Advance(time.Millisecond)
+		}
+	}
+}
+
+func TestCollectResults(t *testing.T) {
+	var results []int
+	var calls int
+	data, err := DoWithData(func() (int, error) {
+		calls++
+		if calls < 4 {
+			return calls * 10, errors.New("error")
+		}
+		return calls * 10, nil
+	}, WithCollectResults(&results, 10), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 40, data)
+	assert.Equal(t, []int{10, 20, 30, 40}, results)
+
+	_, err = DoWithData(func() (int, error) {
+		calls++
+		return calls, errors.New("error")
+	}, WithAttempts(5), WithCollectResults(&results, 2), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	assert.Error(t, err)
+	assert.Equal(t, []int{8, 9}, results, "only the last values within the limit should be kept")
+}
+
+func TestCollectResultsNothingCollected(t *testing.T) {
+	results := []int{1, 2}
+	err := Do(func() error {
+		return nil
+	}, WithCollectResults(&results, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, results, "Do should leave out as is")
+}
+
+func TestCollectResultsShared(t *testing.T) {
+	var results []int
+	opts := []Option{WithAttempts(3), WithCollectResults(&results, 10), WithDelayFn(FixDelayFn, SetFixTimeFn(0))}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _ = DoWithData(func() (int, error) {
+				return i, errors.New("error")
+			}, opts...)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Len(t, results, 3, "out should hold the values of a single call")
+	assert.Equal(t, results[0], results[1])
+	assert.Equal(t, results[0], results[2])
+}
+
+func TestLeaseDeadline(t *testing.T) {
+	expectErr := errors.New("error")
+	lease := time.Now().Add(50 * time.Millisecond)
+	var calls int
+	start := time.Now()
+	err := Do(func() error {
+		calls++
+		return expectErr
+	}, WithAttempts(100), WithLeaseDeadline(func() time.Time { return lease }), WithDelayFn(FixDelayFn, SetFixTimeFn(20*time.Millisecond)))
+	elapsed := time.Since(start)
+
+	assert.True(t, errors.Is(err, ErrLeaseExpired), "the loop should stop when the lease expires")
+	assert.True(t, errors.Is(err, expectErr), "the attempt errors should be kept")
+	assert.InDelta(t, 3, calls, 1, "about three attempts, at 0ms, 20ms and 40ms, fit in the lease")
+	assert.True(t, elapsed < 100*time.Millisecond, fmt.Sprintf("the last delay should be cut to the lease, took %v", elapsed))
+
+	err = Do(func() error { return nil }, WithLeaseDeadline(func() time.Time { return time.Now().Add(-time.Second) }))
+	assert.Equal(t, ErrLeaseExpired, err)
+}
+
+func TestErrorTagger(t *testing.T) {
+	expectErr := errors.New("error")
+	err := Do(func() error {
+		return expectErr
+	}, WithAttempts(3), WithDelayFn(FixDelayFn, SetFixTimeFn(0)), WithErrorTagger(func(attempt uint, err error) map[string]string {
+		return map[string]string{"region": "eu-west-1", "attempt": fmt.Sprint(attempt)}
+	}))
+
+	var tagged TaggedError
+	assert.True(t, errors.As(err, &tagged), "tags should be retrievable from the aggregate")
+	assert.Equal(t, map[string]string{"region": "eu-west-1", "attempt": "0"}, tagged.Tags)
+	assert.True(t, errors.Is(err, expectErr))
+
+	retryErr := err.(Error)
+	for i, err := range retryErr.WrappedErrors() {
+		assert.Equal(t, fmt.Sprint(i), err.(TaggedError).Tags["attempt"])
+	}
+	assert.Equal(t, "Retry Error: \n# 0: error\n# 1: error\n# 2: error", err.Error(), "tags shouldn't change the message")
+}
+
+func TestFillDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var calls int
+	err := Do(func() error {
+		calls++
+		return errors.New("error")
+	}, WithContext(ctx), WithAttempts(2), WithFillDeadline(func(uint, error, *config) time.Duration {
+		return 50 * time.Millisecond
+	}))
+
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.InDelta(t, 10, calls, 2, "attempts should fill the deadline whatever the attempt count")
+	assert.Equal(t, uint(calls), err.(Error).Attempts())
+}
+
+func TestSaturationGuard(t *testing.T) {
+	expectErr := errors.New("throttled")
+	opts := []Option{
+		WithAttempts(10),
+		WithDelayFn(FixDelayFn, SetFixTimeFn(0)),
+		WithSaturationGuard(10*time.Millisecond, 3),
+	}
+
+	var calls int
+	err := Do(func() error {
+		calls++
+		time.Sleep(20 * time.Millisecond)
+		return expectErr
+	}, opts...)
+	assert.True(t, errors.Is(err, expectErr))
+	assert.Equal(t, 3, calls, "the guard should trip after 3 slow failures")
+
+	// a fast failure in between resets the window
+	calls = 0
+	err = Do(func() error {
+		calls++
+		if calls != 3 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return expectErr
+	}, opts...)
+	assert.True(t, errors.Is(err, expectErr))
+	assert.Equal(t, 6, calls)
+}
+
+type topOfMinute struct{}
+
+func (topOfMinute) Next(after time.Time) time.Time {
+	return after.Truncate(time.Minute).Add(time.Minute)
+}
+
+func TestCronDelayFn(t *testing.T) {
+	cfg := newDefaultConfig()
+	clock := retrytest.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 45, 0, time.UTC))
+	cfg.clock = clock
+	df := CronDelayFn(topOfMinute{})
+
+	assert.Equal(t, 15*time.Second, df(0, nil, cfg), "should wait until the next scheduled instant")
+
+	clock.Advance(15 * time.Second)
+	assert.Equal(t, time.Minute, df(1, nil, cfg), "at a scheduled instant the next one is targeted")
+}
+
+func TestLoopGuard(t *testing.T) {
+	var lastResults []bool
+	guard := WithLoopGuard(func(attempt uint, lastResultWasSuccess bool) bool {
+		lastResults = append(lastResults, lastResultWasSuccess)
+		return attempt < 2
+	})
+
+	var calls int
+	err := Do(func() error {
+		calls++
+		return nil
+	}, guard, WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls, "the guard should stop the loop after two successes")
+	assert.Equal(t, []bool{false, true, true}, lastResults)
+
+	expectErr := errors.New("error")
+	calls = 0
+	lastResults = nil
+	err = Do(func() error {
+		calls++
+		return expectErr
+	}, guard, WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+	assert.True(t, errors.Is(err, expectErr))
+	assert.Equal(t, 2, calls, "the guard should stop the loop after two failures")
+	assert.Equal(t, []bool{false, false, false}, lastResults)
+}
+
+func TestLoopGuardData(t *testing.T) {
+	guard := WithLoopGuard(func(attempt uint, lastResultWasSuccess bool) bool {
+		return attempt < 3
+	})
+
+	var calls int
+	data, err := DoWithData(func() (int, error) {
+		calls++
+		return calls, nil
+	}, guard, WithDelay(0))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, data, "the latest successful attempt should count")
+
+	calls = 0
+	data, err = DoWithData(func() (int, error) {
+		calls++
+		if calls == 3 {
+			return 0, errors.New("error")
+		}
+		return calls, nil
+	}, guard, WithDelay(0))
+	assert.Equal(t, 0, data, "a failed call should return the zero value")
+	assert.EqualError(t, err, "Retry Error: \n# 2: error")
+	assert.Equal(t, uint(3), err.(Error).Attempts())
+}
+
+func TestLoopGuardBeforeFirstAttempt(t *testing.T) {
+	var result DoResult
+	var calls int
+	err := Do(func() error {
+		calls++
+		return nil
+	}, WithLoopGuard(func(uint, bool) bool { return false }), WithDoResult(&result))
+	assert.ErrorIs(t, err, ErrLoopGuardStopped)
+	assert.Equal(t, 0, calls)
+	assert.Equal(t, Aborted, result.StopReason)
+}
+
+func TestMaxMinDelayFn(t *testing.T) {
+	constant := func(d time.Duration) DelayFn {
+		return func(uint, error, *config) time.Duration { return d }
+	}
+	delayFns := []DelayFn{constant(20 * time.Millisecond), constant(50 * time.Millisecond), constant(10 * time.Millisecond)}
+	cfg := newDefaultConfig()
+
+	assert.Equal(t, 50*time.Millisecond, MaxDelayFn(delayFns...)(0, nil, cfg))
+	assert.Equal(t, 10*time.Millisecond, MinDelayFn(delayFns...)(0, nil, cfg))
+	assert.Equal(t, time.Duration(0), MaxDelayFn()(0, nil, cfg))
+}
+
+func TestMaxElapsedTime(t *testing.T) {
+	expectErr := errors.New("error")
+	var result DoResult
+	var calls int
+	start := time.Now()
+	err := Do(func() error {
+		calls++
+		return expectErr
+	}, WithAttempts(10), WithMaxElapsedTime(time.Second), WithDelayFn(FixDelayFn, SetFixTimeFn(400*time.Millisecond)), WithDoResult(&result))
+	elapsed := time.Since(start)
+
+	assert.True(t, errors.Is(err, expectErr), "the accumulated errors should be returned")
+	assert.Equal(t, uint(calls), err.(Error).Attempts())
+	assert.InDelta(t, 3, calls, 1, "attempts at 0ms, 400ms and 800ms fit in the budget")
+	assert.Equal(t, MaxElapsed, result.StopReason)
+	assert.True(t, elapsed < time.Second, fmt.Sprintf("Do shouldn't overshoot the budget, took %v", elapsed))
+
+	calls = 0
+	err = Do(func() error {
+		calls++
+		return expectErr
+	}, WithAttempts(2), WithMaxElapsedTime(time.Second), WithDelayFn(FixDelayFn, SetFixTimeFn(0)), WithDoResult(&result))
+	assert.Equal(t, 2, calls, "WithAttempts should win when it is hit first")
+	assert.Equal(t, AttemptsExhausted, result.StopReason)
+}
+
+func TestAnyErrorMatches(t *testing.T) {
+	retryable := statusErr{code: 503}
+	isRetryable := func(err error) bool {
+		status, ok := err.(statusErr)
+		return ok && status.code >= 500
+	}
+
+	assert.True(t, AnyErrorMatches(errors.Join(errors.New("a"), fmt.Errorf("b: %w", retryable)), isRetryable))
+	assert.False(t, AnyErrorMatches(errors.Join(errors.New("a"), statusErr{code: 404}), isRetryable))
+	assert.False(t, AnyErrorMatches(nil, isRetryable))
+
+	var calls int
+	err := Do(func() error {
+		calls++
+		return errors.Join(errors.New("validation"), retryable)
+	}, WithAttempts(3), WithDelayFn(FixDelayFn, SetFixTimeFn(0)), WithRetryIfFn(func(n uint, err error) bool {
+		return AnyErrorMatches(err, isRetryable)
+	}))
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls, "a joined error with a retryable leaf should be retried")
+}
+
+func TestJitterFnBounds(t *testing.T) {
+	delay := 100 * time.Millisecond
+	cfg := newDefaultConfig()
+	for i := 0; i < 1000; i++ {
+		full := FullJitterFn(0, delay, cfg)
+		assert.True(t, full >= 0 && full < delay, fmt.Sprintf("full jitter %v out of [0, %v)", full, delay))
+		equal := EqualJitterFn(0, delay, cfg)
+		assert.True(t, equal >= delay/2 && equal < delay, fmt.Sprintf("equal jitter %v out of [%v, %v)", equal, delay/2, delay))
+	}
+	assert.Equal(t, time.Duration(0), FullJitterFn(0, 0, cfg))
+	assert.Equal(t, time.Duration(0), EqualJitterFn(0, 0, cfg))
+}
+
+func TestWithJitter(t *testing.T) {
+	beginTime := 10 * time.Millisecond
+	maxDelayTime := 300 * time.Millisecond
+	cfg := newConfig(
+		WithDelayFn(BackOffDelayFn, SetBackOffBeginTimeFn(beginTime), SetMaxDelayTimeFn(maxDelayTime)),
+		WithJitter(EqualJitterFn),
+	)
+
+	for i := 0; i < 100; i++ {
+		for n := uint(0); n < 8; n++ {
+			delay, rawDelay := cfg.nextDelay(n, nil)
+			if rawDelay >= maxDelayTime {
+				assert.Equal(t, maxDelayTime, delay, "jitter shouldn't push the delay over the cap")
+				continue
+			}
+			lower := rawDelay + rawDelay/2
+			upper := rawDelay * 2
+			if upper > maxDelayTime {
+				upper = maxDelayTime
+			}
+			assert.True(t, delay >= lower && delay <= upper, fmt.Sprintf("delay %v of attempt %d out of [%v, %v]", delay, n, lower, upper))
+		}
+	}
+}
+
+func TestMaxTotalSleep(t *testing.T) {
+	var result DoResult
+	err := Do(func() error {
+		return errors.New("error")
+	}, WithAttempts(6), WithMaxTotalSleep(25*time.Millisecond), WithDelayFn(FixDelayFn, SetFixTimeFn(10*time.Millisecond)), WithDoResult(&result))
+
+	assert.Error(t, err)
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{10 * ms, 10 * ms, 5 * ms, 0, 0}, result.Delays, "the delay that doesn't fit should shrink")
+	var total time.Duration
+	for _, delay := range result.Delays {
+		total += delay
+	}
+	assert.True(t, total <= 25*ms, fmt.Sprintf("total sleep %v over the budget", total))
+}
+
+func TestInfiniteAttempts(t *testing.T) {
+	var calls int
+	err := Do(func() error {
+		calls++
+		if calls < 4 {
+			return errors.New("error")
+		}
+		return nil
+	}, WithAttempts(0), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 4, calls, "attempts 0 should retry until success")
+
+	calls = 0
+	expectErr := errors.New("fatal")
+	err = Do(func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("error")
+		}
+		return UnrecoverableError(expectErr)
+	}, WithAttempts(0), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	assert.True(t, errors.Is(err, expectErr))
+	assert.Equal(t, 3, calls, "an unrecoverable error should stop the infinite loop")
+	assert.Equal(t, uint(3), err.(Error).Attempts())
+}
+
+func TestOnSleepFn(t *testing.T) {
+	maxDelayTime := 12 * time.Millisecond
+	var sleeps []time.Duration
+	var sleepStarts, attemptStarts []time.Time
+	var result DoResult
+	err := Do(func() error {
+		attemptStarts = append(attemptStarts, time.Now())
+		return errors.New("error")
+	}, WithAttempts(5), WithDelayFn(BackOffDelayFn, SetBackOffBeginTimeFn(2*time.Millisecond), SetMaxDelayTimeFn(maxDelayTime)),
+		WithJitter(FullJitterFn), WithDoResult(&result),
+		WithOnSleepFn(func(attempt uint, sleep time.Duration) {
+			sleeps = append(sleeps, sleep)
+			sleepStarts = append(sleepStarts, time.Now())
+		}))
+
+	assert.Error(t, err)
+	assert.Equal(t, result.Delays, sleeps, "the reported sleeps should be the final delays")
+	for i, sleep := range sleeps {
+		assert.True(t, sleep <= maxDelayTime, fmt.Sprintf("sleep %v over the cap", sleep))
+		waited := attemptStarts[i+1].Sub(sleepStarts[i])
+		assert.True(t, waited >= sleep, fmt.Sprintf("waited %v, reported %v", waited, sleep))
+	}
+}
+
+func TestDecorrelatedJitterDelayFn(t *testing.T) {
+	base := 10 * time.Millisecond
+	maxDelayTime := 500 * time.Millisecond
+	cfg := newConfig(WithDelayFn(DecorrelatedJitterDelayFn, SetDecorrelatedBaseFn(base), SetMaxDelayTimeFn(maxDelayTime)))
+
+	for i := 0; i < 100; i++ {
+		prev := base
+		for n := uint(0); n < 10; n++ {
+			delay, _ := cfg.nextDelay(n, nil)
+			upper := 3 * prev
+			if upper > maxDelayTime {
+				upper = maxDelayTime
+			}
+			assert.True(t, delay >= base && delay <= upper, fmt.Sprintf("delay %v of attempt %d out of [%v, %v]", delay, n, base, upper))
+			prev = delay
+		}
+	}
+}
+
+func TestLinearDelayFn(t *testing.T) {
+	base := 10 * time.Millisecond
+	cfg := newConfig(WithDelayFn(LinearDelayFn, SetFixTimeFn(base), SetMaxDelayTimeFn(45*time.Millisecond)))
+
+	expected := []time.Duration{base, 2 * base, 3 * base, 4 * base, 45 * time.Millisecond}
+	for n, want := range expected {
+		delay, _ := cfg.nextDelay(uint(n), nil)
+		assert.Equal(t, want, delay, fmt.Sprintf("delay after attempt %d", n))
+	}
+	assert.Equal(t, time.Duration(math.MaxInt64), LinearDelayFn(math.MaxUint32, nil, &config{delayTime: time.Hour}))
+
+	cfg = newConfig(WithDelayFn(CombineDelayFn(LinearDelayFn, RandomDelayFn), SetFixTimeFn(base), SetRamdomTimeFn(base)))
+	for i := 0; i < 100; i++ {
+		delay, _ := cfg.nextDelay(2, nil)
+		assert.True(t, delay >= 3*base && delay < 4*base, fmt.Sprintf("combined delay %v out of [%v, %v)", delay, 3*base, 4*base))
+	}
+}
+
+func TestGoogleTruncatedExponentialDelayFn(t *testing.T) {
+	base := 10 * time.Millisecond
+	randomTime := 5 * time.Millisecond
+	maxDelayTime := 200 * time.Millisecond
+	cfg := newConfig(WithDelayFn(GoogleTruncatedExponentialDelayFn, SetBackOffBeginTimeFn(base), SetRamdomTimeFn(randomTime), SetMaxDelayTimeFn(maxDelayTime)))
+
+	for i := 0; i < 100; i++ {
+		for n := uint(0); n < 5; n++ {
+			delay, _ := cfg.nextDelay(n, nil)
+			lower := time.Duration(1<<n-1) * base
+			assert.True(t, delay >= lower && delay < lower+randomTime, fmt.Sprintf("delay %v of attempt %d out of [%v, %v)", delay, n, lower, lower+randomTime))
+		}
+		for _, n := range []uint{5, 10, 100} {
+			delay, _ := cfg.nextDelay(n, nil)
+			assert.Equal(t, maxDelayTime, delay, fmt.Sprintf("delay of attempt %d should be truncated", n))
+		}
+	}
+}
+
+func TestFibonacciDelayFn(t *testing.T) {
+	base := time.Millisecond
+	cfg := newConfig(WithDelayFn(FibonacciDelayFn, SetFixTimeFn(base)))
+
+	expected := []time.Duration{1, 1, 2, 3, 5, 8, 13}
+	for n, multiple := range expected {
+		delay, _ := cfg.nextDelay(uint(n), nil)
+		assert.Equal(t, multiple*base, delay, fmt.Sprintf("delay after attempt %d", n))
+	}
+	delay, _ := cfg.nextDelay(3, nil)
+	assert.Equal(t, 3*base, delay, "going back should recompute the sequence")
+
+	cfg = newConfig(WithDelayFn(FibonacciDelayFn, SetFixTimeFn(time.Hour), SetMaxDelayTimeFn(24*time.Hour)))
+	delay, _ = cfg.nextDelay(200, nil)
+	assert.Equal(t, 24*time.Hour, delay, "large terms should be clamped to the max delay time")
+}
+
+func TestRetryOnErrors(t *testing.T) {
+	errTimeout := errors.New("timeout")
+	errThrottled := errors.New("throttled")
+	errInvalid := errors.New("invalid")
+	opts := []Option{WithAttempts(3), WithDelayFn(FixDelayFn, SetFixTimeFn(0)), WithRetryOnErrors(errTimeout, errThrottled)}
+
+	for _, tc := range []struct {
+		err   error
+		calls int
+	}{
+		{errTimeout, 3},
+		{fmt.Errorf("call: %w", errThrottled), 3},
+		{errInvalid, 1},
+		{fmt.Errorf("call: %w", errInvalid), 1},
+	} {
+		var calls int
+		err := Do(func() error {
+			calls++
+			return tc.err
+		}, opts...)
+		assert.Error(t, err)
+		assert.Equal(t, tc.calls, calls, tc.err.Error())
+	}
+
+	var calls int
+	err := Do(func() error {
+		calls++
+		return errTimeout
+	}, append(opts, WithRetryIfFn(func(n uint, err error) bool { return n < 1 }))...)
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls, "the RetryIfFn should still apply")
+}
+
+func TestAbortOnErrors(t *testing.T) {
+	errFatal := errors.New("fatal")
+	opts := []Option{WithAttempts(3), WithDelayFn(FixDelayFn, SetFixTimeFn(0)), WithAbortOnErrors(errFatal)}
+
+	var calls int
+	err := Do(func() error {
+		calls++
+		if calls == 2 {
+			return fmt.Errorf("call: %w", errFatal)
+		}
+		return errors.New("error")
+	}, opts...)
+	assert.True(t, errors.Is(err, errFatal))
+	assert.Equal(t, 2, calls, "a wrapped abort error should stop retries")
+
+	calls = 0
+	err = Do(func() error {
+		calls++
+		return errors.New("error")
+	}, append(opts, WithRetryIfFn(func(n uint, err error) bool { return true }))...)
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls, "other errors should be retried")
+}
+
+func TestShutdownContext(t *testing.T) {
+	shutdown, cancel := context.WithCancel(context.Background())
+	expectErr := errors.New("error")
+	var calls int
+	var finished bool
+	start := time.Now()
+	err := DoWithContext(context.Background(), func(ctx context.Context) error {
+		calls++
+		cancel()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+		}
+		finished = true
+		return expectErr
+	}, WithShutdownContext(shutdown), WithDelayFn(FixDelayFn, SetFixTimeFn(time.Second)))
+
+	assert.True(t, finished, "the attempt in flight shouldn't be interrupted")
+	assert.Equal(t, 1, calls, "no retry should start after shutdown")
+	assert.True(t, errors.Is(err, expectErr))
+	assert.True(t, time.Since(start) < time.Second, "the delay shouldn't be waited for")
+
+	err = Do(func() error { return nil }, WithShutdownContext(shutdown))
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestOnSuccessFn(t *testing.T) {
+	var successes []uint
+	onSuccess := WithOnSuccessFn(func(attempts uint) {
+		successes = append(successes, attempts)
+	})
+
+	err := Do(func() error { return nil }, onSuccess)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{1}, successes, "first-try success should report 1 attempt")
+
+	var calls int
+	err = Do(func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("error")
+		}
+		return nil
+	}, onSuccess, WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{1, 3}, successes)
+
+	err = Do(func() error {
+		return errors.New("error")
+	}, onSuccess, WithAttempts(2), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+	assert.Error(t, err)
+	assert.Equal(t, []uint{1, 3}, successes, "failures shouldn't call the hook")
+}
+
+func TestDelayRounding(t *testing.T) {
+	cfg := newConfig(WithDelayFn(FixDelayFn, SetFixTimeFn(137*time.Millisecond)), WithDelayRounding(10*time.Millisecond))
+	delay, rawDelay := cfg.nextDelay(0, nil)
+	assert.Equal(t, 130*time.Millisecond, delay, "the delay should be rounded down")
+	assert.Equal(t, 137*time.Millisecond, rawDelay)
+
+	var result DoResult
+	start := time.Now()
+	calls := 0
+	_ = Do(func() error {
+		calls++
+		return errors.New("error")
+	}, WithAttempts(2), WithDelayFn(FixDelayFn, SetFixTimeFn(137*time.Millisecond)), WithDelayRounding(10*time.Millisecond), WithDoResult(&result))
+	elapsed := time.Since(start)
+	assert.Equal(t, []time.Duration{130 * time.Millisecond}, result.Delays)
+	assert.True(t, elapsed >= 130*time.Millisecond && elapsed < 137*time.Millisecond+50*time.Millisecond, fmt.Sprintf("slept %v", elapsed))
+}
+
+func TestAttemptTimeout(t *testing.T) {
+	var calls int
+	start := time.Now()
+	err := DoWithContext(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			// a hanging attempt
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}, WithAttemptTimeout(20*time.Millisecond), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls, "timed out attempts should be retried")
+	assert.True(t, time.Since(start) < time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start = time.Now()
+	err = DoWithContext(ctx, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, WithAttemptTimeout(time.Second))
+	assert.True(t, errors.Is(err, context.Canceled), "the attempt context should derive from the Do context")
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestStopWhenDelayExceeds(t *testing.T) {
+	expectErr := errors.New("error")
+	var result DoResult
+	var calls int
+	err := Do(func() error {
+		calls++
+		return expectErr
+	}, WithAttempts(10), WithDelayFn(BackOffDelayFn, SetBackOffBeginTimeFn(time.Millisecond)),
+		WithStopWhenDelayExceeds(5*time.Millisecond), WithDoResult(&result))
+
+	assert.True(t, errors.Is(err, expectErr))
+	// delays of 1ms, 2ms and 4ms, then 8ms is over the threshold
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond}, result.Delays)
+	assert.Equal(t, Aborted, result.StopReason)
+}
+
+func TestErrorExhausted(t *testing.T) {
+	var result DoResult
+	err := Do(func() error {
+		return errors.New("error")
+	}, WithAttempts(3), WithDelayFn(FixDelayFn, SetFixTimeFn(0)), WithDoResult(&result))
+	assert.Error(t, err)
+	assert.Equal(t, AttemptsExhausted, result.StopReason, "running out of attempts should be reported")
+	assert.True(t, err.(Error).Exhausted(), "running out of attempts should be reported")
+	assert.EqualError(t, err, "Retry Error: \n# 0: error\n# 1: error\n# 2: error")
+
+	err = Do(func() error {
+		return errors.New("error")
+	}, WithAttempts(3), WithDelayFn(FixDelayFn, SetFixTimeFn(0)), WithRetryIfFn(func(n uint, err error) bool {
+		return n < 1
+	}), WithDoResult(&result))
+	assert.Equal(t, uint(2), err.(Error).Attempts())
+	assert.Equal(t, Aborted, result.StopReason, "a RetryIfFn stop isn't exhaustion")
+	assert.False(t, err.(Error).Exhausted(), "a RetryIfFn stop isn't exhaustion")
+
+	err = Do(func() error {
+		return UnrecoverableError(errors.New("error"))
+	}, WithAttempts(3), WithDoResult(&result))
+	assert.Equal(t, Aborted, result.StopReason)
+	assert.False(t, err.(Error).Exhausted())
+}
+
+func TestRandSource(t *testing.T) {
+	delays := func(seed int64) []time.Duration {
+		var result DoResult
+		_ = Do(func() error {
+			return errors.New("error")
+		}, WithAttempts(6), WithDelayFn(RandomDelayFn, SetRamdomTimeFn(time.Millisecond)), WithRandSource(rand.NewSource(seed)), WithDoResult(&result))
+		return result.Delays
+	}
+
+	assert.Equal(t, delays(1), delays(1), "the same source should give the same delays")
+	assert.NotEqual(t, delays(1), delays(2), "different sources should give different delays")
+}
+
+type tokenKey struct{}
+
+func TestRefreshContext(t *testing.T) {
+	refresh := func(parent context.Context, attempt uint) (context.Context, error) {
+		if attempt == 3 {
+			return nil, errors.New("token refresh failed")
+		}
+		return context.WithValue(parent, tokenKey{}, fmt.Sprintf("token-%d", attempt)), nil
+	}
+
+	var tokens []string
+	err := DoWithContext(context.Background(), func(ctx context.Context) error {
+		tokens = append(tokens, ctx.Value(tokenKey{}).(string))
+		if len(tokens) < 3 {
+			return errors.New("unauthorized")
+		}
+		return nil
+	}, WithRefreshContext(refresh), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"token-0", "token-1", "token-2"}, tokens, "every attempt should get a fresh token")
+
+	var calls int
+	err = DoWithContext(context.Background(), func(ctx context.Context) error {
+		calls++
+		return errors.New("unauthorized")
+	}, WithRefreshContext(refresh), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+	assert.Equal(t, 3, calls, "a refresh error should stop the loop")
+	assert.Equal(t, "Retry Error: \n# 0: unauthorized\n# 1: unauthorized\n# 2: unauthorized\n# 3: token refresh failed", err.Error())
+}
+
+func TestWithDelay(t *testing.T) {
+	delays := func(opts ...Option) []time.Duration {
+		var result DoResult
+		_ = Do(func() error {
+			return errors.New("error")
+		}, append(opts, WithAttempts(3), WithDoResult(&result))...)
+		return result.Delays
+	}
+
+	delay := 5 * time.Millisecond
+	assert.Equal(t, delays(WithDelayFn(FixDelayFn, SetFixTimeFn(delay))), delays(WithDelay(delay)))
+	assert.Equal(t, []time.Duration{delay, delay}, delays(WithDelay(delay)))
+	assert.Equal(t, []time.Duration{time.Millisecond, time.Millisecond}, delays(WithDelay(delay), WithMaxDelay(time.Millisecond)), "a later WithMaxDelay should cap the delay")
+	assert.Equal(t, []time.Duration{time.Millisecond, time.Millisecond}, delays(WithMaxDelay(time.Millisecond), WithDelay(delay)))
+}
+
+func TestMinAttemptInterval(t *testing.T) {
+	interval := 10 * time.Millisecond
+	var starts []time.Time
+	err := Do(func() error {
+		starts = append(starts, time.Now())
+		return errors.New("error")
+	}, WithAttempts(4), WithDelayFn(FixDelayFn, SetFixTimeFn(0)), WithMinAttemptInterval(interval))
+
+	assert.Error(t, err)
+	assert.Len(t, starts, 4)
+	for i := 1; i < len(starts); i++ {
+		gap := starts[i].Sub(starts[i-1])
+		assert.True(t, gap >= interval, fmt.Sprintf("attempts %d and %d only %v apart", i-1, i, gap))
+	}
+}
+
+func TestRetryImmediately(t *testing.T) {
+	expectErr := errors.New("transient")
+	var result DoResult
+	var calls int
+	start := time.Now()
+	err := Do(func() error {
+		calls++
+		switch calls {
+		case 1:
+			return RetryImmediately(expectErr)
+		case 2:
+			return expectErr
+		}
+		return nil
+	}, WithDelayFn(FixDelayFn, SetFixTimeFn(50*time.Millisecond)), WithDoResult(&result))
+	elapsed := time.Since(start)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []time.Duration{0, 50 * time.Millisecond}, result.Delays, "only the immediate retry should skip the delay")
+	assert.True(t, elapsed < 90*time.Millisecond, fmt.Sprintf("took %v", elapsed))
+
+	err = Do(func() error {
+		return RetryImmediately(expectErr)
+	}, WithAttempts(2))
+	assert.Equal(t, []error{expectErr, expectErr}, err.(Error).WrappedErrors(), "the wrapper should be removed from the recorded errors")
+	assert.True(t, IsRetryImmediately(RetryImmediately(expectErr)))
+	assert.False(t, IsRetryImmediately(expectErr))
+}
+
+func TestRampUpDownDelayFn(t *testing.T) {
+	base := time.Millisecond
+	cfg := newConfig(WithDelayFn(RampUpDownDelayFn(3), SetBackOffBeginTimeFn(base)))
+
+	expected := []time.Duration{1, 2, 4, 8, 4, 2, 1, 1}
+	for n, multiple := range expected {
+		delay, _ := cfg.nextDelay(uint(n), nil)
+		assert.Equal(t, multiple*base, delay, fmt.Sprintf("delay after attempt %d", n))
+	}
+}
+
+func TestDelayCappedToContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var result DoResult
+	start := time.Now()
+	err := Do(func() error {
+		return errors.New("error")
+	}, WithContext(ctx), WithDelayFn(FixDelayFn, SetFixTimeFn(5*time.Second)), WithDoResult(&result))
+	elapsed := time.Since(start)
+
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, elapsed < 300*time.Millisecond, fmt.Sprintf("took %v", elapsed))
+	assert.Len(t, result.Delays, 1)
+	assert.True(t, result.Delays[0] <= 200*time.Millisecond, fmt.Sprintf("the delay %v should be capped to the deadline", result.Delays[0]))
+	assert.Equal(t, 5*time.Second, result.RawDelays[0])
+}
+
+func TestEnrichErrors(t *testing.T) {
+	expectErr := errors.New("error")
+	start := time.Now()
+	err := Do(func() error {
+		return UnrecoverableError(expectErr)
+	}, WithEnrichErrors(true))
+
+	var enriched EnrichedError
+	assert.True(t, errors.As(err, &enriched), "the enrichment should be exposed through errors.As")
+	assert.Equal(t, expectErr, enriched.Err)
+	assert.Equal(t, goroutineID(), enriched.Goroutine, "without parallelism f runs in the caller goroutine")
+	assert.False(t, enriched.When.Before(start))
+
+	err = Do(func() error {
+		return expectErr
+	}, WithAttempts(3), WithParallelism(2), WithEnrichErrors(true), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	goroutines := map[int]bool{}
+	for _, err := range err.(Error).WrappedErrors() {
+		enriched := err.(EnrichedError)
+		assert.NotZero(t, enriched.Goroutine)
+		goroutines[enriched.Goroutine] = true
+	}
+	assert.Len(t, goroutines, 3, "attempts run in different goroutines should record distinct ids")
+	assert.True(t, errors.Is(err, expectErr))
+}
+
+func TestDoWithContextCancelledMidAttempt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	var calls int
+	var observed error
+	err := DoWithContext(ctx, func(ctx context.Context) error {
+		calls++
+		close(started)
+		<-ctx.Done()
+		observed = ctx.Err()
+		return observed
+	}, WithContext(context.Background()))
+
+	assert.Equal(t, 1, calls, "should not retry once the context is cancelled")
+	assert.Equal(t, context.Canceled, observed, "f should see the cancellation of the explicit ctx")
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestDeadlineFractionDelayFn(t *testing.T) {
+	clock := retrytest.NewFakeClock(time.Now())
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(time.Second))
+	defer cancel()
+	cfg := newConfig(WithContext(ctx), WithClock(clock))
+
+	assert.Equal(t, 250*time.Millisecond, DeadlineFractionDelayFn(0.25, 0)(0, nil, cfg))
+
+	df := DeadlineFractionDelayFn(0.25, 0.2)
+	for i := 0; i < 100; i++ {
+		d := df(0, nil, cfg)
+		assert.True(t, d >= 200*time.Millisecond && d <= 300*time.Millisecond, fmt.Sprintf("%v should be 250ms ±20%%", d))
+	}
+
+	clock.Advance(600 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, DeadlineFractionDelayFn(0.25, 0)(1, nil, cfg), "should shrink with the time left")
+
+	clock.Advance(time.Second)
+	assert.Equal(t, time.Duration(0), DeadlineFractionDelayFn(0.25, 0)(2, nil, cfg), "should not be negative past the deadline")
+	assert.Equal(t, time.Duration(0), DeadlineFractionDelayFn(0.25, 0)(0, nil, newDefaultConfig()), "should not wait without a deadline")
+}
+
+func TestDoUntil(t *testing.T) {
+	var counter int
+	v, err := DoUntil(func() (int, error) {
+		counter++
+		return counter, nil
+	}, func(v int) bool {
+		return v >= 3
+	}, WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, v)
+	assert.Equal(t, 3, counter, "should stop polling once done")
+
+	counter = 0
+	_, err = DoUntil(func() (int, error) {
+		counter++
+		return counter, nil
+	}, func(v int) bool {
+		return v >= 10
+	}, WithAttempts(3), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+	assert.True(t, errors.Is(err, ErrResultRejected), "should give up when the attempts run out")
+	assert.Equal(t, 3, counter)
+
+	expectErr := errors.New("error")
+	counter = 0
+	_, err = DoUntil(func() (int, error) {
+		counter++
+		return 0, UnrecoverableError(expectErr)
+	}, func(int) bool {
+		return true
+	})
+	assert.True(t, errors.Is(err, expectErr))
+	assert.Equal(t, 1, counter, "should stop on unrecoverable errors")
+}
+
+func TestDoPollUntil(t *testing.T) {
+	var result DoResult
+	var calls int
+	status, err := DoPollUntil(func() (string, error) {
+		calls++
+		if calls < 4 {
+			return "pending", nil
+		}
+		return "ready", nil
+	}, func(status string) bool {
+		return status == "ready"
+	}, WithDoResult(&result))
+	assert.NoError(t, err)
+	assert.Equal(t, "ready", status)
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, []time.Duration{1, 2, 4}, scaleDurations(result.Delays, defaultPollDelay), "should back off exponentially")
+
+	calls = 0
+	status, err = DoPollUntil(func() (string, error) {
+		calls++
+		return "pending", nil
+	}, func(status string) bool {
+		return status == "ready"
+	}, WithAttempts(3), WithDelayFn(BackOffDelayFn, SetFixTimeFn(time.Millisecond)))
+	assert.Equal(t, "", status, "should return the zero value on exhaustion")
+	assert.Equal(t, 3, calls)
+	assert.Len(t, err.(Error).WrappedErrors(), 3)
+	assert.True(t, errors.Is(err, ErrResultRejected))
+}
+
+func TestExponentialBackoffWithJitterFn(t *testing.T) {
+	base := 10 * time.Millisecond
+	maxDelay := 50 * time.Millisecond
+	cfg := newConfig(WithDelayFn(ExponentialBackoffWithJitterFn, SetBackOffBeginTimeFn(base), SetMaxDelayTimeFn(maxDelay)))
+
+	seen := map[time.Duration]bool{}
+	for n := uint(0); n < 6; n++ {
+		bound := base << n
+		if bound > maxDelay {
+			bound = maxDelay
+		}
+		for i := 0; i < 50; i++ {
+			d := ExponentialBackoffWithJitterFn(n, nil, cfg)
+			assert.True(t, d >= 0 && d < bound, fmt.Sprintf("delay %v of attempt %d should be below %v", d, n, bound))
+			seen[d] = true
+		}
+	}
+	assert.True(t, len(seen) > 1, "delays should be randomized")
+}
+
+type severityErr struct {
+	msg      string
+	severity int
+}
+
+func (e severityErr) Error() string { return e.msg }
+
+func TestErrorSelector(t *testing.T) {
+	critical := severityErr{"disk failure", 3}
+	errs := []error{severityErr{"timeout", 1}, severityErr{"throttled", 2}, critical, severityErr{"timeout", 1}}
+	mostSevere := WithErrorSelector(func(errs []error) error {
+		var selected error
+		top := -1
+		for _, err := range errs {
+			var s severityErr
+			if errors.As(err, &s) && s.severity > top {
+				selected, top = err, s.severity
+			}
+		}
+		return selected
+	})
+
+	var calls int
+	err := Do(func() error {
+		calls++
+		return errs[calls-1]
+	}, mostSevere, WithAttempts(uint(len(errs))))
+	assert.Equal(t, critical, err, "should return the most severe error")
+}
+
+func TestCombineDelayFnMode(t *testing.T) {
+	short := func(uint, error, *config) time.Duration { return 10 * time.Millisecond }
+	long := func(uint, error, *config) time.Duration { return 30 * time.Millisecond }
+	cfg := newDefaultConfig()
+
+	assert.Equal(t, 40*time.Millisecond, CombineDelayFnMode(CombineSum, short, long)(0, nil, cfg))
+	assert.Equal(t, 30*time.Millisecond, CombineDelayFnMode(CombineMax, short, long)(0, nil, cfg))
+	assert.Equal(t, 10*time.Millisecond, CombineDelayFnMode(CombineMin, long, short)(0, nil, cfg))
+	assert.Equal(t, 40*time.Millisecond, CombineDelayFn(short, long)(0, nil, cfg), "CombineDelayFn should still sum")
+}
+
+type queueDepthErr struct{ depth int }
+
+func (e queueDepthErr) Error() string { return fmt.Sprintf("%d requests queued", e.depth) }
+
+func TestQueueDepthDelayFn(t *testing.T) {
+	perUnit := 20 * time.Millisecond
+	df := QueueDepthDelayFn(func(err error) int {
+		var q queueDepthErr
+		if errors.As(err, &q) {
+			return q.depth
+		}
+		return 0
+	}, perUnit)
+	cfg := newConfig(WithDelayFn(df, SetMaxDelayTimeFn(time.Second)))
+
+	assert.Equal(t, 5*perUnit, df(0, queueDepthErr{5}, cfg))
+	assert.Equal(t, time.Duration(0), df(0, errors.New("error"), cfg), "errors without a depth should not wait")
+	assert.Equal(t, time.Second, df(0, queueDepthErr{math.MaxInt32}, cfg), "should be capped at the max delay")
+}
+
+func TestRetryAfterDelayFn(t *testing.T) {
+	clock := retrytest.NewFakeClock(time.Now())
+	var result DoResult
+	var calls int32
+	done := make(chan error, 1)
+	go func() {
+		done <- Do(func() error {
+			if atomic.AddInt32(&calls, 1) <= 2 {
+				return RetryAfter(errors.New("429 Too Many Requests"), 2*time.Second)
+			}
+			return nil
+		}, WithDelayFn(RetryAfterDelayFn(FixDelayFn), SetFixTimeFn(time.Minute)),
+			WithClock(clock),
+			WithDoResult(&result))
+	}()
+
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(2 * time.Second)
+	}
+	assert.NoError(t, <-done)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, []time.Duration{2 * time.Second, 2 * time.Second}, result.Delays, "the server hints should replace the local backoff")
+
+	cfg := newConfig(WithDelayFn(FixDelayFn, SetFixTimeFn(time.Minute)))
+	assert.Equal(t, time.Minute, RetryAfterDelayFn(FixDelayFn)(0, errors.New("error"), cfg), "should fall back without a hint")
+}
+
+func TestRequireCancellableContext(t *testing.T) {
+	var calls int
+	f := func() error {
+		calls++
+		return UnrecoverableError(errors.New("error"))
+	}
+
+	err := Do(f, WithContext(context.Background()), WithAttempts(0), WithRequireCancellableContext(true))
+	assert.Equal(t, ErrContextNotCancellable, err)
+	assert.Equal(t, 0, calls, "should not make any attempt")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = Do(f, WithContext(ctx), WithAttempts(0), WithRequireCancellableContext(true))
+	assert.NotEqual(t, ErrContextNotCancellable, err)
+	assert.Equal(t, 1, calls, "a cancellable context should be accepted")
+
+	err = Do(f, WithContext(context.Background()), WithAttempts(3), WithRequireCancellableContext(true))
+	assert.NotEqual(t, ErrContextNotCancellable, err, "bounded attempts don't need a cancellable context")
+}
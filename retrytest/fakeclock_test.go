@@ -0,0 +1,32 @@
+package retrytest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	assert.Equal(t, start, clock.Now())
+
+	short := clock.After(time.Second)
+	long := clock.After(time.Minute)
+	clock.BlockUntil(2)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), <-short)
+	select {
+	case <-long:
+		t.Fatal("the longer wait shouldn't fire yet")
+	default:
+	}
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, start.Add(time.Minute+time.Second), <-long)
+	assert.Equal(t, start.Add(time.Minute+time.Second), clock.Now())
+
+	assert.Equal(t, clock.Now(), <-clock.After(0), "a zero wait should fire right away")
+}
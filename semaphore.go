@@ -0,0 +1,52 @@
+package retry
+
+import (
+	"context"
+	"sync"
+)
+
+var globalSemaphore struct {
+	mu sync.RWMutex
+	ch chan struct{}
+}
+
+// SetGlobalMaxConcurrency limits how many attempts of Do calls may run at
+// the same time across the whole process. Attempts over the limit wait for a
+// slot, or for their context to be done; the delays between attempts don't
+// hold a slot. A Do nested in an attempt runs in the slot of that attempt
+// when it gets the attempt context, through DoWithContext or WithContext;
+// without it, it waits for a slot of its own. 0 removes the limit.
+func SetGlobalMaxConcurrency(n uint) {
+	globalSemaphore.mu.Lock()
+	defer globalSemaphore.mu.Unlock()
+	if n == 0 {
+		globalSemaphore.ch = nil
+		return
+	}
+	globalSemaphore.ch = make(chan struct{}, n)
+}
+
+// globalSlotKey marks the context of an attempt holding a global slot.
+type globalSlotKey struct{}
+
+// acquireGlobalSemaphore takes a global slot for the attempt of ctx, unless
+// it already holds one, and returns the context to give the attempt, marked
+// as holding it.
+func acquireGlobalSemaphore(ctx context.Context) (slotCtx context.Context, release func(), err error) {
+	if ctx.Value(globalSlotKey{}) != nil {
+		return ctx, func() {}, nil
+	}
+	globalSemaphore.mu.RLock()
+	ch := globalSemaphore.ch
+	globalSemaphore.mu.RUnlock()
+
+	if ch == nil {
+		return ctx, func() {}, nil
+	}
+	select {
+	case ch <- struct{}{}:
+		return context.WithValue(ctx, globalSlotKey{}, struct{}{}), func() { <-ch }, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
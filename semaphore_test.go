@@ -0,0 +1,84 @@
+package retry
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetGlobalMaxConcurrency(t *testing.T) {
+	maxConcurrency := uint(2)
+	SetGlobalMaxConcurrency(maxConcurrency)
+	defer SetGlobalMaxConcurrency(0)
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = Do(func() error {
+				cur := atomic.AddInt32(&running, 1)
+				for {
+					seen := atomic.LoadInt32(&maxRunning)
+					if cur <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, cur) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(maxConcurrency), atomic.LoadInt32(&maxRunning), "no more than %v Do bodies should run concurrently", maxConcurrency)
+}
+
+func TestSetGlobalMaxConcurrencyContext(t *testing.T) {
+	SetGlobalMaxConcurrency(1)
+	defer SetGlobalMaxConcurrency(0)
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_ = Do(func() error {
+			close(started)
+			<-done
+			return nil
+		})
+	}()
+	<-started
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := Do(func() error {
+		return nil
+	}, WithContext(ctx))
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestSetGlobalMaxConcurrencyNested(t *testing.T) {
+	SetGlobalMaxConcurrency(1)
+	defer SetGlobalMaxConcurrency(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var innerCalls int
+	err := DoWithContext(ctx, func(ctx context.Context) error {
+		return DoWithContext(ctx, func(ctx context.Context) error {
+			innerCalls++
+			return nil
+		})
+	})
+
+	assert.NoError(t, err, "a nested Do should run in the slot of its outer attempt")
+	assert.Equal(t, 1, innerCalls)
+}
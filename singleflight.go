@@ -0,0 +1,49 @@
+package retry
+
+import (
+	"context"
+	"sync"
+)
+
+// Group coalesces concurrent DoWithData calls that use WithSingleFlight with
+// the same key: the first call runs its retry loop and the others wait for
+// it and share its data and error, unless their own context ends first. The
+// zero value is ready to use.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*groupCall
+}
+
+type groupCall struct {
+	done chan struct{}
+	data interface{}
+	err  error
+}
+
+func (g *Group) do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*groupCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.data, c.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c := &groupCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.data, c.err = fn()
+	return c.data, c.err
+}
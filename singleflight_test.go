@@ -0,0 +1,193 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSingleFlight(t *testing.T) {
+	var group Group
+	var calls int32
+	release := make(chan struct{})
+	f := func() (int, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]int, 10)
+	errs := make([]error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = DoWithData(f, WithSingleFlight("key", &group))
+		}(i)
+	}
+	// give every caller the time to join the in-flight call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "f should run once")
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, errs[i])
+		assert.Equal(t, 42, results[i], fmt.Sprintf("caller %d", i))
+	}
+}
+
+func TestSingleFlightFollowerContext(t *testing.T) {
+	var group Group
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		_, _ = DoWithData(func() (int, error) {
+			close(started)
+			<-release
+			return 42, nil
+		}, WithSingleFlight("key", &group))
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	data, err := DoWithData(func() (int, error) {
+		return 0, nil
+	}, WithSingleFlight("key", &group), WithContext(ctx))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, data)
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "the follower shouldn't wait for the leader past its context")
+}
+
+func TestSingleFlightDifferentKeys(t *testing.T) {
+	var group Group
+	var calls int32
+	f := func() (int, error) {
+		atomic.AddInt32(&calls, 1)
+		return 0, nil
+	}
+
+	_, err := DoWithData(f, WithSingleFlight("a", &group))
+	assert.NoError(t, err)
+	_, err = DoWithData(f, WithSingleFlight("b", &group))
+	assert.NoError(t, err)
+	_, err = DoWithData(f, WithSingleFlight("a", &group))
+	assert.NoError(t, err)
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "calls that don't overlap shouldn't be coalesced")
+}
+
+func TestDoWithData(t *testing.T) {
+	var calls int
+	data, err := DoWithData(func() (string, error) {
+		calls++
+		if calls < 3 {
+			return "", errors.New("error")
+		}
+		return "ok", nil
+	}, WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", data)
+	assert.Equal(t, 3, calls)
+}
+
+func TestDoWithDataContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	data, err := DoWithData(func() (string, error) {
+		cancel()
+		return "partial", errors.New("error")
+	}, WithContext(ctx))
+
+	assert.Equal(t, "", data, "the zero value should be returned")
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestDoSingleFlight(t *testing.T) {
+	var group Group
+	var calls int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, Do(func() error {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return nil
+			}, WithSingleFlight("key", &group)))
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "Do should share the in-flight call too")
+}
+
+func TestSingleFlightEntryPoints(t *testing.T) {
+	var group Group
+	var calls int32
+	release := make(chan struct{})
+	f := func() error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, DoNamed("op", f, WithSingleFlight("key", &group)))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, DoWithContext(context.Background(), func(context.Context) error {
+				return f()
+			}, WithSingleFlight("key", &group)))
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "DoNamed and DoWithContext should share the in-flight call too")
+}
+
+func TestDoWithPartialData(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	data, err := DoWithPartialData(func(prev []int) ([]int, error) {
+		next := append(prev, len(prev)+1)
+		if len(next) == 3 {
+			cancel()
+		}
+		return next, errors.New("page failed")
+	}, WithContext(ctx), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, []int{1, 2, 3}, data, "the data accumulated so far should be returned")
+
+	data, err = DoWithPartialData(func(prev []int) ([]int, error) {
+		next := append(prev, len(prev)+1)
+		if len(next) < 4 {
+			return next, errors.New("page failed")
+		}
+		return next, nil
+	}, WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4}, data)
+}
@@ -0,0 +1,26 @@
+package retry
+
+import "time"
+
+// State is where a Do call stands between two attempts, to be persisted with
+// WithState and picked up by ResumeDo after a restart. It marshals to JSON.
+type State struct {
+	// Attempts is how many attempts were made.
+	Attempts uint `json:"attempts"`
+	// NextDelay is the delay before the next attempt.
+	NextDelay time.Duration `json:"next_delay"`
+}
+
+// ResumeDo is like Do but picks up where a Do call whose state was saved with
+// WithState left off: it waits the NextDelay of state, then goes on from
+// attempt state.Attempts, so the attempts count towards WithAttempts and the
+// delays keep growing from there. The errors are numbered from that attempt
+// too. A state with no attempts left returns ErrResumeExhausted.
+func ResumeDo(state State, f func() error, opts ...Option) error {
+	cfg := newConfig(opts...)
+	cfg.resume = &state
+	_, err := doWithData(func() (struct{}, error) {
+		return struct{}{}, f()
+	}, cfg)
+	return err
+}
@@ -0,0 +1,70 @@
+package retry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeDo(t *testing.T) {
+	base := time.Millisecond
+	opts := []Option{WithAttempts(6), WithDelayFn(BackOffDelayFn, SetBackOffBeginTimeFn(base))}
+
+	// the process stops while sleeping after the third attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	var state State
+	var calls int
+	err := Do(func() error {
+		calls++
+		if calls == 3 {
+			cancel()
+		}
+		return errors.New("error")
+	}, append(opts, WithContext(ctx), WithState(&state))...)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, State{Attempts: 3, NextDelay: 4 * base}, state)
+
+	saved, err := json.Marshal(state)
+	assert.NoError(t, err)
+	var restored State
+	assert.NoError(t, json.Unmarshal(saved, &restored))
+
+	var result DoResult
+	var attempts []uint
+	calls = 0
+	err = ResumeDo(restored, func() error {
+		calls++
+		return errors.New("error")
+	}, append(opts, WithDoResult(&result), WithOnRetryFn(func(n uint, err error) {
+		attempts = append(attempts, n)
+	}))...)
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls, "should only make the attempts left")
+	assert.Equal(t, []uint{3, 4, 5}, attempts)
+	assert.Equal(t, []time.Duration{8 * base, 16 * base}, result.Delays, "the backoff should go on from the saved attempt")
+}
+
+func TestResumeDoErrorNumbering(t *testing.T) {
+	err := ResumeDo(State{Attempts: 3}, func() error {
+		return errors.New("error")
+	}, WithAttempts(5), WithDelay(0))
+
+	var e Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, "Retry Error: \n# 3: error\n# 4: error", err.Error())
+	assert.Equal(t, uint(5), e.Attempts())
+}
+
+func TestResumeDoExhausted(t *testing.T) {
+	var calls int
+	err := ResumeDo(State{Attempts: 3}, func() error {
+		calls++
+		return nil
+	}, WithAttempts(3))
+	assert.ErrorIs(t, err, ErrResumeExhausted)
+	assert.Equal(t, 0, calls)
+}
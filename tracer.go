@@ -0,0 +1,37 @@
+package retry
+
+import "context"
+
+// Tracer starts a span around every attempt of a Do call. The attributes use
+// the same keys as the StructuredLogger fields.
+type Tracer interface {
+	Start(ctx context.Context, name string, attributes map[string]interface{}) (context.Context, Span)
+}
+
+// Span is ended with the error of the attempt it covers, nil on success.
+type Span interface {
+	End(err error)
+}
+
+const attemptSpanName = "retry.attempt"
+
+type noopSpan struct{}
+
+func (noopSpan) End(error) {}
+
+func (c *config) startSpan(ctx context.Context, n uint) (context.Context, Span) {
+	if c.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	attributes := map[string]interface{}{
+		LogFieldAttempt:       c.attemptNumber(n),
+		LogFieldCorrelationID: c.correlationID,
+	}
+	if c.name != "" {
+		attributes[LogFieldName] = c.name
+	}
+	if c.operation != "" {
+		attributes[LogFieldOperation] = c.operation
+	}
+	return c.tracer.Start(ctx, attemptSpanName, attributes)
+}
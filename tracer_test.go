@@ -0,0 +1,70 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordedSpan struct {
+	name       string
+	attributes map[string]interface{}
+	err        error
+}
+
+type mockTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *mockTracer) Start(ctx context.Context, name string, attributes map[string]interface{}) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &recordedSpan{name: name, attributes: attributes}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func (s *recordedSpan) End(err error) {
+	s.err = err
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &mockTracer{}
+	expectErr := errors.New("error")
+	calls := 0
+	err := Do(func() error {
+		calls++
+		if calls < 2 {
+			return expectErr
+		}
+		return nil
+	}, WithTracer(tracer), WithName("fetch"), WithDelayFn(FixDelayFn, SetFixTimeFn(0)))
+
+	assert.NoError(t, err)
+	assert.Len(t, tracer.spans, 2)
+	for i, span := range tracer.spans {
+		assert.Equal(t, attemptSpanName, span.name)
+		assert.Equal(t, uint(i), span.attributes[LogFieldAttempt])
+		assert.Equal(t, "fetch", span.attributes[LogFieldName])
+		assert.NotContains(t, span.attributes, LogFieldOperation)
+	}
+	assert.Equal(t, expectErr, tracer.spans[0].err)
+	assert.NoError(t, tracer.spans[1].err)
+}
+
+func TestDoNamed(t *testing.T) {
+	tracer := &mockTracer{}
+	logger := &recordingLogger{}
+	err := DoNamed("get-user", func() error { return nil }, WithTracer(tracer), WithName("users"), WithStructuredLogger(logger))
+
+	assert.NoError(t, err)
+	assert.Len(t, tracer.spans, 1)
+	assert.Equal(t, "get-user", tracer.spans[0].attributes[LogFieldOperation])
+	assert.Equal(t, "users", tracer.spans[0].attributes[LogFieldName])
+	assert.Len(t, logger.fields, 1)
+	assert.Equal(t, "get-user", logger.fields[0][LogFieldOperation])
+}